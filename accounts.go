@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	// Random string generation,
+	"github.com/dchest/uniuri"
+
+	// Password hashing,
+	"golang.org/x/crypto/bcrypt"
+
+	// Routing,
+	"github.com/gorilla/mux"
+)
+
+// sessionLifetime is how long a login lasts.
+const sessionLifetime = 30 * 24 * time.Hour
+
+// sessionCookie is the name of the cookie that holds the session token.
+const sessionCookie = "session"
+
+// minPasswordLength is the shortest password an account may have.
+const minPasswordLength = 8
+
+// validUsername matches the names that can be registered.
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,30}$`)
+
+// OwnedPaste is one of the pastes on the my pastes page.
+type OwnedPaste struct {
+	Created   string
+	Editable  bool
+	Expiry    string
+	Id        string
+	Protected bool
+	Revision  int
+	Title     string
+}
+
+// AccountPage is used for generating the login and my pastes pages.
+type AccountPage struct {
+	Pastes       []OwnedPaste
+	Registration bool
+	Title        string
+	User         string
+	WrapperErr   string
+}
+
+// sessionHash returns what's stored of a session token, so that the tokens
+// can't be taken from the database.
+func sessionHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionUser returns the name of the logged in user, "" if the client isn't
+// logged in.
+func sessionUser(r *http.Request) string {
+
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+
+	sess, err := users.GetSession(sessionHash(c.Value))
+	switch {
+	case err == ErrNotFound:
+		return ""
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	if sess.Expiry <= time.Now().Unix() {
+		loggy("Session has ended.")
+		return ""
+	}
+	return sess.User
+}
+
+// mayChange reports whether the client may edit or delete the paste, with
+// the delkey or as the logged in owner.
+func mayChange(r *http.Request, p Paste, delKey string) bool {
+
+	if delKey != "" &&
+		subtle.ConstantTimeCompare([]byte(delKey), []byte(p.DelKey)) == 1 {
+		return true
+	}
+
+	user := sessionUser(r)
+	return user != "" && user == p.Owner
+}
+
+// clientAddr returns the address the request came from, without the port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession logs the user in. The cookie is only sent by the browser for
+// requests from our own pages, which is what keeps other sites from editing
+// or deleting pastes on behalf of the user.
+func startSession(w http.ResponseWriter, r *http.Request, name string) {
+
+	token := uniuri.NewLen(40)
+	expiry := time.Now().Add(sessionLifetime)
+
+	err := users.SaveSession(Session{Token: sessionHash(token), User: name,
+		Expiry: expiry.Unix()})
+	if err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	loggy(fmt.Sprintf("User '%s' logged in.", name))
+}
+
+// loginPage shows the login form with the status.
+func loginPage(w http.ResponseWriter, code int, status string) {
+
+	page := &AccountPage{
+		Registration: configuration.Registration,
+		Title:        configuration.DisplayName,
+		WrapperErr:   status,
+	}
+
+	w.WriteHeader(code)
+	err := templates.ExecuteTemplate(w, "login.html", page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// LoginHandler shows the login form, and logs the user in when it's posted.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		loginPage(w, http.StatusOK, "")
+		return
+	}
+
+	name := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	// The same limit as for the passwords of pastes, per address so that
+	// someone guessing can't lock the user out everywhere else,
+	key := "user/" + name + "/" + clientAddr(r)
+	if !passwordAttempts.allowed(key) {
+		loggy(fmt.Sprintf("Too many wrong passwords for user '%s'.", name))
+		loginPage(w, http.StatusTooManyRequests, "Too many login attempts.")
+		return
+	}
+
+	u, err := users.GetUser(name)
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(u.Password),
+		[]byte(password)) != nil {
+		loggy(fmt.Sprintf("Wrong user name or password given for '%s'.", name))
+		passwordAttempts.failed(key)
+		loginPage(w, http.StatusUnauthorized, "Wrong user name or password.")
+		return
+	}
+
+	startSession(w, r, u.Name)
+	http.Redirect(w, r, "/mine", http.StatusSeeOther)
+}
+
+// RegisterHandler creates an account and logs the new user in, if
+// registration is enabled.
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !configuration.Registration {
+		loginPage(w, http.StatusForbidden, "Registration is disabled.")
+		return
+	}
+
+	name := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	if !validUsername.MatchString(name) {
+		loginPage(w, http.StatusBadRequest,
+			"User names are 1-30 letters, digits, dots, dashes or underscores.")
+		return
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		loginPage(w, http.StatusBadRequest, fmt.Sprintf(
+			"Passwords are %d-%d characters.", minPasswordLength, maxPasswordLength))
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		loggy(fmt.Sprintf("Could not hash the password of user '%s' : %s", name, err))
+		loginPage(w, http.StatusInternalServerError, "Could not create the account.")
+		return
+	}
+
+	err = users.SaveUser(User{Name: name, Password: hash,
+		Created: time.Now().Unix()})
+	switch {
+	case err == ErrUserExists:
+		loginPage(w, http.StatusConflict, "The user name is taken.")
+		return
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	loggy(fmt.Sprintf("Registered user '%s'.", name))
+	startSession(w, r, name)
+	http.Redirect(w, r, "/mine", http.StatusSeeOther)
+}
+
+// LogoutHandler ends the session.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := users.DeleteSession(sessionHash(c.Value)); err != nil {
+			debugLogger.Println("   Database error : " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// MineHandler lists the pastes of the logged in user. Nothing is viewed, so
+// pastes with a view limit or that are burned after reading are left as they
+// are.
+func MineHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := sessionUser(r)
+	if user == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	owned, err := users.Owned(user)
+	if err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	var pastes []OwnedPaste
+	for _, p := range owned {
+		if !checkPasteExpiry(p.Id, p.Expiry) {
+			continue
+		}
+
+		created, expiry := "", "Never"
+		if p.Created != 0 {
+			created = time.Unix(p.Created, 0).Format("2006-01-02 15:04:05")
+		}
+		switch {
+		case p.Burn:
+			expiry = "Burn after reading"
+		case p.Expiry != 0:
+			expiry = time.Unix(p.Expiry, 0).Format("2006-01-02 15:04:05")
+		}
+
+		pastes = append(pastes, OwnedPaste{
+			Created:   created,
+			Editable:  !p.Binary && !p.Encrypted && len(p.Files) == 0,
+			Expiry:    expiry,
+			Id:        p.Id,
+			Protected: p.Password != "",
+			Revision:  p.Revision,
+			Title:     p.Title,
+		})
+	}
+
+	page := &AccountPage{
+		Pastes: pastes,
+		Title:  "Pastes of " + user,
+		User:   user,
+	}
+
+	err = templates.ExecuteTemplate(w, "mine.html", page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// EditPageHandler shows a paste of the logged in user in the editor, it's
+// saved as a new revision. The paste is read straight from the store, so
+// opening the editor doesn't count as a view.
+func EditPageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pasteId := vars["pasteId"]
+
+	p, err := store.Get(pasteId)
+	switch {
+	case err == ErrNotFound:
+		notfoundHandler(w, pasteId)
+		return
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	if !checkPasteExpiry(pasteId, p.Expiry) {
+		notfoundHandler(w, pasteId)
+		return
+	}
+
+	user := sessionUser(r)
+	if user == "" || user != p.Owner {
+		http.Error(w, "Only the owner can edit the paste.", http.StatusForbidden)
+		return
+	}
+
+	// Ciphertext and binary data can't be edited in the browser, and there's
+	// only room for one file,
+	if p.Binary || p.Encrypted || len(pasteFiles(pasteId)) > 0 {
+		http.Error(w, "Only text pastes can be edited.", http.StatusBadRequest)
+		return
+	}
+
+	listOfLangsFirst, listOfLangsLast, _ := supportedLists()
+	page := &Page{
+		Body:       template.HTML(p.Data),
+		EditId:     pasteId,
+		LangsFirst: listOfLangsFirst,
+		LangsLast:  listOfLangsLast,
+		PasteTitle: p.Title,
+		Title:      "Edit " + p.Title,
+		User:       user,
+	}
+
+	err = templates.ExecuteTemplate(w, "index.html", page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// form posts the form values to the path.
+func form(path string, values url.Values, header map[string]string) *http.Response {
+
+	h := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	for k, v := range header {
+		h[k] = v
+	}
+	return do("POST", path, values.Encode(), h).Result()
+}
+
+// register creates an account and returns the header with its session.
+func register(t *testing.T, name string, password string) map[string]string {
+	t.Helper()
+
+	resp := form("/register", url.Values{"username": {name}, "password": {password}}, nil)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("register : got %d", resp.StatusCode)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			return map[string]string{"Cookie": c.Name + "=" + c.Value}
+		}
+	}
+	t.Fatalf("no session cookie")
+	return nil
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+	resetStore()
+	configuration.Registration = false
+
+	resp := form("/register", url.Values{"username": {"alice"},
+		"password": {"correct horse"}}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("register : got %d", resp.StatusCode)
+	}
+	if _, err := users.GetUser("alice"); err != ErrNotFound {
+		t.Fatalf("user was saved (%v)", err)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	resetStore()
+	configuration.Registration = true
+	defer func() { configuration.Registration = false }()
+
+	session := register(t, "alice", "correct horse")
+
+	// The name is taken now, and the passwords are checked,
+	resp := form("/register", url.Values{"username": {"alice"},
+		"password": {"correct horse"}}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("taken name : got %d", resp.StatusCode)
+	}
+	for _, password := range []string{"short", strings.Repeat("x", maxPasswordLength+1)} {
+		resp := form("/register", url.Values{"username": {"bob"},
+			"password": {password}}, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("password of %d characters : got %d", len(password),
+				resp.StatusCode)
+		}
+	}
+
+	// Pastes saved while logged in are owned, and listed,
+	w := do("POST", "/api", `{"paste": "owned", "title": "Mine"}`,
+		map[string]string{"Content-Type": "application/json",
+			"Cookie": session["Cookie"]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("save : got %d", w.Code)
+	}
+	owned, err := users.Owned("alice")
+	if err != nil || len(owned) != 1 || owned[0].Title != "Mine" {
+		t.Fatalf("owned : got %+v (%v)", owned, err)
+	}
+	if w := do("GET", "/mine", "", session); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "Mine") {
+		t.Fatalf("mine : got %d", w.Code)
+	}
+
+	// The owner deletes without the delkey,
+	if w := do("DELETE", "/api/"+owned[0].Id, "", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("delete without session : got %d", w.Code)
+	}
+	if w := do("DELETE", "/api/"+owned[0].Id, "", session); w.Code != http.StatusOK {
+		t.Fatalf("delete by owner : got %d", w.Code)
+	}
+
+	// Login and logout,
+	resp = form("/login", url.Values{"username": {"alice"}, "password": {"wrong"}}, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password : got %d", resp.StatusCode)
+	}
+	resp = form("/login", url.Values{"username": {"alice"},
+		"password": {"correct horse"}}, nil)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login : got %d", resp.StatusCode)
+	}
+
+	form("/logout", nil, session)
+	if w := do("GET", "/mine", "", session); w.Code != http.StatusSeeOther {
+		t.Fatalf("mine after logout : got %d", w.Code)
+	}
+}
+
+// login posts the login form from the address and returns the code.
+func login(name string, password string, addr string) int {
+
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"username": {name}, "password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = addr
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestLoginAttempts(t *testing.T) {
+	resetStore()
+	configuration.Registration = true
+	defer func() { configuration.Registration = false }()
+
+	register(t, "alice", "correct horse")
+
+	for i := 0; i < maxPasswordAttempts; i++ {
+		if code := login("alice", "wrong", "192.0.2.1:1000"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d : got %d", i+1, code)
+		}
+	}
+
+	// The address that guessed is locked out, even from another port, but
+	// the user can still log in from anywhere else,
+	if code := login("alice", "correct horse", "192.0.2.1:2000"); code != http.StatusTooManyRequests {
+		t.Fatalf("after too many attempts : got %d", code)
+	}
+	if code := login("alice", "correct horse", "198.51.100.1:1000"); code != http.StatusSeeOther {
+		t.Fatalf("from another address : got %d", code)
+	}
+}
@@ -0,0 +1,55 @@
+// Client side encryption of pastes. A paste is encrypted with AES-GCM using a
+// random 256 bit key, the server only ever gets the base64 of the 12 byte iv
+// followed by the ciphertext. The key is kept in the url fragment, which the
+// browser never sends to the server.
+
+function b64_to_bytes(b64) {
+  b64 = b64.replace(/-/g, "+").replace(/_/g, "/");
+  while (b64.length % 4) {
+    b64 += "=";
+  }
+  return Uint8Array.from(atob(b64), function (c) { return c.charCodeAt(0); });
+}
+
+
+function bytes_to_b64(bytes) {
+  var str = "";
+  for (var x = 0; x < bytes.length; x++) {
+    str += String.fromCharCode(bytes[x]);
+  }
+  return btoa(str);
+}
+
+
+// encrypt_paste encrypts text with a new key. Returns an object with the
+// ciphertext (data) and the url safe key (key).
+async function encrypt_paste(text) {
+  const key = await crypto.subtle.generateKey({ name: "AES-GCM", length: 256 }, true, ["encrypt"]);
+  const iv = crypto.getRandomValues(new Uint8Array(12));
+  const cipher = new Uint8Array(await crypto.subtle.encrypt({ name: "AES-GCM", iv: iv }, key,
+    new TextEncoder().encode(text)));
+  const raw_key = new Uint8Array(await crypto.subtle.exportKey("raw", key));
+
+  var data = new Uint8Array(iv.length + cipher.length);
+  data.set(iv);
+  data.set(cipher, iv.length);
+
+  return {
+    data: bytes_to_b64(data),
+    key: bytes_to_b64(raw_key).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "")
+  };
+}
+
+
+// decrypt_paste decrypts ciphertext created by encrypt_paste with the given
+// key, if no key is given the one in the url fragment is used.
+async function decrypt_paste(ciphertext, key_b64) {
+  if (key_b64 === undefined) {
+    key_b64 = window.location.hash.substr(1);
+  }
+
+  const data = b64_to_bytes(ciphertext.trim());
+  const key = await crypto.subtle.importKey("raw", b64_to_bytes(key_b64), "AES-GCM", false, ["decrypt"]);
+  const plain = await crypto.subtle.decrypt({ name: "AES-GCM", iv: data.slice(0, 12) }, key, data.slice(12));
+  return new TextDecoder().decode(plain);
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// maxBundleFiles is the max number of files in a bundle.
+const maxBundleFiles = 20
+
+// RequestFile is one of the files of a bundle, as sent by the client.
+type RequestFile struct {
+	Binary   bool   `json:"-"`        // If the file is binary (only uploads)
+	Filename string `json:"filename"` // The name of the file
+	Lang     string `json:"lang"`     // The language of the file, picked from the name if not given
+	Paste    string `json:"paste"`    // The file data
+}
+
+// BundleFile is one of the files of a bundle, as returned to the client.
+type BundleFile struct {
+	Filename string `json:"filename"`        // The name of the file
+	Lang     string `json:"lang"`            // The language of the file
+	Paste    string `json:"paste,omitempty"` // The file data (not when saving)
+	Sha1     string `json:"sha1"`            // The sha1 of the file
+	Size     int    `json:"size"`            // The length of the file
+	Url      string `json:"url"`             // The raw url of the file
+}
+
+// PageFile is one of the files of a bundle on the paste page.
+type PageFile struct {
+	Body     template.HTML
+	Extra    string
+	Filename string
+	Lang     string
+	RawPath  string
+}
+
+// unpackBundle checks the files of a bundle and moves the first one to where
+// a single paste keeps its data, the rest are left in Files.
+func unpackBundle(inData *Request) error {
+
+	if inData.Paste != "" {
+		return errors.New("give either paste or files, not both")
+	}
+	if len(inData.Files) > maxBundleFiles {
+		return fmt.Errorf("too many files (max %d)", maxBundleFiles)
+	}
+
+	// The key of an encrypted paste lives in the url fragment, which can't
+	// be shared by several raw urls,
+	if inData.Encrypted {
+		return errors.New("bundles can't be encrypted")
+	}
+
+	seen := make(map[string]bool)
+	for i := range inData.Files {
+		f := &inData.Files[i]
+
+		if f.Binary {
+			return errors.New("bundles can only hold text files")
+		}
+		if f.Paste == "" {
+			return fmt.Errorf("file %d is empty", i+1)
+		}
+
+		// Every file needs a name of its own, it's part of the raw url,
+		f.Filename = cleanFilename(f.Filename)
+		if f.Filename == "" {
+			f.Filename = fmt.Sprintf("file%d", i+1)
+		}
+		if len(f.Filename) > 255 || len(f.Lang) > 50 {
+			return fmt.Errorf("file name or language of file %d to long", i+1)
+		}
+		if seen[f.Filename] {
+			return fmt.Errorf("file name '%s' is given more than once", f.Filename)
+		}
+		seen[f.Filename] = true
+	}
+
+	first := inData.Files[0]
+	inData.Paste, inData.Filename, inData.Lang = first.Paste, first.Filename,
+		first.Lang
+	inData.Files = inData.Files[1:]
+	return nil
+}
+
+// bundleHash hashes all the files of a bundle, which is what identifies it.
+// It never matches a single paste with the same data as the first file.
+func bundleHash(inData Request) string {
+
+	var b strings.Builder
+	b.WriteString(inData.Filename + "\x00" + inData.Paste + "\x00")
+	for _, f := range inData.Files {
+		b.WriteString(f.Filename + "\x00" + f.Paste + "\x00")
+	}
+	return shaPaste(b.String())
+}
+
+// newFiles returns the files of the bundle after the first one, ready to be
+// saved. The languages are picked the same way as for a single paste.
+func newFiles(inData Request) []File {
+
+	var files []File
+	for _, f := range inData.Files {
+		lang := pasteLang(Request{Filename: f.Filename, Lang: f.Lang,
+			Paste: f.Paste, Style: inData.Style})
+		files = append(files, File{
+			Filename: f.Filename,
+			Lang:     lang,
+			Hash:     shaPaste(f.Paste),
+			Data:     f.Paste,
+		})
+	}
+	return files
+}
+
+// pasteFiles returns the files of the paste after the first one, none if
+// it isn't a bundle.
+func pasteFiles(pasteId string) []File {
+
+	files, err := store.Files(pasteId)
+	if err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+	return files
+}
+
+// invalidateRenders removes the renderings of a paste that is gone, along
+// with the ones of the other files if it's a bundle.
+func invalidateRenders(hash string, files []File) {
+	pasteCache.invalidate(hash)
+	for _, f := range files {
+		pasteCache.invalidate(f.Hash)
+	}
+}
+
+// bundleFiles returns all the files of a bundle, the first one is the paste
+// itself.
+func bundleFiles(p Paste, files []File) []BundleFile {
+
+	list := []BundleFile{{
+		Filename: p.Filename,
+		Lang:     p.Lang,
+		Paste:    p.Data,
+		Sha1:     shaPaste(p.Data),
+		Size:     len(p.Data),
+	}}
+	for _, f := range files {
+		list = append(list, BundleFile{
+			Filename: f.Filename,
+			Lang:     f.Lang,
+			Paste:    f.Data,
+			Sha1:     f.Hash,
+			Size:     len(f.Data),
+		})
+	}
+	return list
+}
+
+// filePath returns the path of the raw file of a bundle.
+func filePath(pasteId string, filename string) string {
+	return "/raw/" + pasteId + "/" + url.PathEscape(filename)
+}
+
+// setFileUrls fills in the raw urls of the files of a bundle.
+func setFileUrls(files []BundleFile, pasteId string, hostname string) {
+	for i := range files {
+		files[i].Url = hostname + filePath(pasteId, files[i].Filename)
+	}
+}
+
+// hasFile reports whether the bundle has a file with the given name, the
+// first one is the paste itself. A single paste has no files at all.
+func hasFile(p Paste, files []File, filename string) bool {
+
+	if len(files) == 0 {
+		return false
+	}
+	if p.Filename == filename {
+		return true
+	}
+	for _, f := range files {
+		if f.Filename == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// findFile returns the file of the bundle with the given name.
+func findFile(files []BundleFile, filename string) (BundleFile, bool) {
+	for _, f := range files {
+		if f.Filename == filename {
+			return f, true
+		}
+	}
+	return BundleFile{}, false
+}
+
+// renderBundle runs every file of a bundle through the highlighter with its
+// own language, or the markdown renderer. Returns the files and the style
+// that was used.
+func renderBundle(p Response, style string, render string) ([]PageFile, string) {
+
+	var files []PageFile
+	for i, f := range p.Files {
+
+		// The files are cached by their own hash, as long as the bundle may
+		// be cached at all. The first file is the paste itself and goes with
+		// its hash, see invalidateRenders,
+		hash := cacheHash(p)
+		if hash != "" && i > 0 {
+			hash = f.Sha1
+		}
+
+		pf := PageFile{Filename: f.Filename, Lang: f.Lang,
+			RawPath: filePath(p.Id, f.Filename)}
+		var body string
+		if render == markdownMode {
+			body, pf.Extra, style = renderMarkdown(hash, f.Paste, style)
+		} else {
+			body, pf.Extra, pf.Lang, style = high(hash, f.Paste, f.Lang, style, nil)
+		}
+		pf.Body = template.HTML(body)
+		files = append(files, pf)
+	}
+	return files, style
+}
+
+// writeBundleZip sends all the files of a bundle as a zip archive.
+func writeBundleZip(w http.ResponseWriter, p Response) {
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": p.Title + ".zip"}))
+	w.Header().Set("Content-Type", "application/zip")
+
+	// The headers are already sent if something goes wrong, so all that can
+	// be done is to log it,
+	zw := zip.NewWriter(w)
+	for _, f := range p.Files {
+		fw, err := zw.Create(f.Filename)
+		if err == nil {
+			_, err = fw.Write([]byte(f.Paste))
+		}
+		if err != nil {
+			loggy(fmt.Sprintf("Could not write the zip of bundle '%s' : %s", p.Id, err))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		loggy(fmt.Sprintf("Could not write the zip of bundle '%s' : %s", p.Id, err))
+	}
+}
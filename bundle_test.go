@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"files": []map[string]string{
+		{"filename": "main.go", "paste": "package main\n"},
+		{"filename": "README.md", "paste": "# Readme\n"},
+	}})
+	if len(saved.Files) != 2 || saved.Files[0].Lang != "go" || saved.Files[1].Paste != "" {
+		t.Fatalf("files : got %+v", saved.Files)
+	}
+
+	if code, body := raw(saved.Id+"/README.md", nil); code != http.StatusOK || body != "# Readme\n" {
+		t.Fatalf("raw file : got %d %q", code, body)
+	}
+	if w := do("GET", "/p/"+saved.Id, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("page : got %d", w.Code)
+	}
+
+	// The download is a zip of all the files,
+	w := do("GET", "/download/"+saved.Id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download : got %d", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[1].Name != "README.md" {
+		t.Fatalf("zip : got %d files", len(zr.File))
+	}
+	f, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "package main\n" {
+		t.Fatalf("zip : got %q", data)
+	}
+}
+
+func TestBadBundles(t *testing.T) {
+	resetStore()
+
+	for name, body := range map[string]string{
+		"paste and files": `{"paste": "x", "files": [{"paste": "y"}]}`,
+		"encrypted":       `{"encrypted": true, "files": [{"paste": "eA=="}]}`,
+		"empty file":      `{"files": [{"filename": "a", "paste": "x"}, {"filename": "b", "paste": ""}]}`,
+		"same name":       `{"files": [{"filename": "a", "paste": "x"}, {"filename": "a", "paste": "y"}]}`,
+	} {
+		w := do("POST", "/api", body, map[string]string{"Content-Type": "application/json"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s : got %d", name, w.Code)
+		}
+	}
+}
+
+// cachedRenders returns the number of cached renderings of the hash.
+func cachedRenders(hash string) int {
+	pasteCache.mu.Lock()
+	defer pasteCache.mu.Unlock()
+
+	n := 0
+	for key := range pasteCache.data {
+		if strings.HasPrefix(key, hash+".") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBundleRendersGoWithIt(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+
+		files := []map[string]string{
+			{"filename": "first.go", "paste": "package first\n"},
+			{"filename": "second.go", "paste": "package second\n"},
+		}
+		hashes := []string{shaPaste("package first\n"), shaPaste("package second\n")}
+
+		// Deleted,
+		saved := save(t, map[string]interface{}{"files": files})
+		if w := do("GET", "/p/"+saved.Id, "", nil); w.Code != http.StatusOK {
+			t.Fatalf("page : got %d", w.Code)
+		}
+		if cachedRenders(saved.Sha1) == 0 || cachedRenders(hashes[1]) == 0 {
+			t.Fatalf("the files weren't cached")
+		}
+		w := do("DELETE", "/api/"+saved.Id+"?delkey="+saved.DelKey, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete : got %d", w.Code)
+		}
+		for _, hash := range append(hashes, saved.Sha1) {
+			if n := cachedRenders(hash); n != 0 {
+				t.Fatalf("%d renderings of %s left after the delete", n, hash)
+			}
+		}
+
+		// Expired,
+		saved = save(t, map[string]interface{}{"files": files, "expiry": "2"})
+		if w := do("GET", "/p/"+saved.Id, "", nil); w.Code != http.StatusOK {
+			t.Fatalf("page : got %d", w.Code)
+		}
+		if cachedRenders(saved.Sha1) == 0 || cachedRenders(hashes[1]) == 0 {
+			t.Fatalf("the files weren't cached")
+		}
+		p, err := store.Get(saved.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Until(time.Unix(p.Expiry, 0)))
+		if n := reapExpired(); n != 1 {
+			t.Fatalf("reaped : got %d", n)
+		}
+		for _, hash := range append(hashes, saved.Sha1) {
+			if n := cachedRenders(hash); n != 0 {
+				t.Fatalf("%d renderings of %s left after the expiry", n, hash)
+			}
+		}
+	})
+}
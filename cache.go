@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCacheSize is used when cachesize isn't set in config.json.
+const defaultCacheSize = 1000
+
+// cacheKeyFormat matches the keys made by cacheKey, the base64 sha1 of the
+// paste and the hex sha1 of the variant. Files in the cache dir that don't
+// match aren't ours and are never touched.
+var cacheKeyFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{27}=\.[0-9a-f]{40}$`)
+
+// renderCacheHits and renderCacheMisses counts the lookups in the render
+// cache, they're exposed on /metrics.
+var renderCacheHits int64
+var renderCacheMisses int64
+
+// rendered is the output of the highlighter for a paste.
+type rendered struct {
+	Html  string `json:"html"`
+	Extra string `json:"extra"`
+	Lang  string `json:"lang"`
+	Style string `json:"style"`
+}
+
+// lru keeps track of the order in which keys have been used and evicts the
+// least recently used one when there are more than max keys.
+type lru struct {
+	max   int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+// newLru returns an empty lru that holds at most max keys.
+func newLru(max int) *lru {
+	return &lru{max: max, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// touch marks the key as used (adding it if needed) and returns the keys that
+// were evicted to make room for it.
+func (l *lru) touch(key string) []string {
+
+	if e, ok := l.keys[key]; ok {
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.keys[key] = l.order.PushFront(key)
+
+	var evicted []string
+	for l.order.Len() > l.max {
+		e := l.order.Back()
+		l.remove(e.Value.(string))
+		evicted = append(evicted, e.Value.(string))
+	}
+	return evicted
+}
+
+// remove drops the key.
+func (l *lru) remove(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.Remove(e)
+		delete(l.keys, key)
+	}
+}
+
+// renderCache is a bounded cache of highlighted pastes, keyed by the hash of
+// the paste, the language and the style. The entries are kept in memory and,
+// if dir is set, also on disk so they survive a restart. Both are bounded to
+// size entries.
+type renderCache struct {
+	mu     sync.Mutex
+	dir    string
+	memory *lru
+	disk   *lru
+	data   map[string]rendered
+}
+
+// newRenderCache returns a cache with room for size entries. If dir isn't
+// empty it's created if needed and the entries that are already in it are
+// picked up, the most recently written first. Other files in dir are left
+// alone.
+func newRenderCache(size int, dir string) (*renderCache, error) {
+
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	c := &renderCache{
+		dir:    dir,
+		memory: newLru(size),
+		data:   make(map[string]rendered),
+	}
+
+	if dir == "" {
+		return c, nil
+	}
+
+	c.disk = newLru(size)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Oldest first so that the newest ends up at the front,
+	type entry struct {
+		key   string
+		mtime int64
+	}
+	var entries []entry
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() ||
+			!cacheKeyFormat.MatchString(f.Name()) {
+			continue
+		}
+		entries = append(entries, entry{f.Name(), info.ModTime().UnixNano()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mtime < entries[j].mtime
+	})
+
+	for _, e := range entries {
+		for _, evicted := range c.disk.touch(e.key) {
+			os.Remove(filepath.Join(dir, evicted))
+		}
+	}
+
+	loggy(fmt.Sprintf("Render cache picked up %d entries from %s",
+		len(c.disk.keys), dir))
+	return c, nil
+}
+
+// cacheKey returns the key of a rendered paste, which is also the file name
+// on disk. It starts with the hash of the paste so that all the entries of a
+// paste can be found when it's removed.
+func cacheKey(hash string, lang string, style string, hl []lineRange) string {
+	hash = strings.TrimSpace(hash)
+	variant := lang + "/" + style
+	if len(hl) > 0 {
+		variant += "/" + formatLineRanges(hl)
+	}
+	sum := sha1.Sum([]byte(variant))
+	return hash + "." + hex.EncodeToString(sum[:])
+}
+
+// get returns the cached rendering of the paste, if any.
+func (c *renderCache) get(hash string, lang string, style string, hl []lineRange) (rendered, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(hash, lang, style, hl)
+	r, ok := c.data[key]
+	if !ok && c.disk != nil {
+		if _, onDisk := c.disk.keys[key]; onDisk {
+			r, ok = c.read(key)
+			if ok {
+				c.remember(key, r)
+			}
+		}
+	}
+
+	if !ok {
+		atomic.AddInt64(&renderCacheMisses, 1)
+		return rendered{}, false
+	}
+
+	c.memory.touch(key)
+	if c.disk != nil {
+		c.disk.touch(key)
+	}
+	atomic.AddInt64(&renderCacheHits, 1)
+	return r, true
+}
+
+// put stores the rendering of the paste.
+func (c *renderCache) put(hash string, lang string, style string, hl []lineRange, r rendered) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(hash, lang, style, hl)
+	c.remember(key, r)
+
+	if c.disk == nil {
+		return
+	}
+
+	d, err := json.Marshal(r)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(c.dir, key), d, 0600)
+	}
+	if err != nil {
+		loggy(fmt.Sprintf("Could not write render cache entry : %s", err))
+		return
+	}
+
+	for _, evicted := range c.disk.touch(key) {
+		os.Remove(filepath.Join(c.dir, evicted))
+	}
+}
+
+// remember keeps the rendering in memory, the lock must be held.
+func (c *renderCache) remember(key string, r rendered) {
+	c.data[key] = r
+	for _, evicted := range c.memory.touch(key) {
+		delete(c.data, evicted)
+	}
+}
+
+// read reads an entry from disk, the lock must be held.
+func (c *renderCache) read(key string) (rendered, bool) {
+
+	var r rendered
+	d, err := os.ReadFile(filepath.Join(c.dir, key))
+	if err == nil {
+		err = json.Unmarshal(d, &r)
+	}
+	if err != nil {
+		loggy(fmt.Sprintf("Could not read render cache entry : %s", err))
+		c.disk.remove(key)
+		return r, false
+	}
+	return r, true
+}
+
+// invalidate removes every rendering of the paste with the given hash, it's
+// called when a paste is deleted or has expired.
+func (c *renderCache) invalidate(hash string) {
+	hash = strings.TrimSpace(hash)
+	if hash == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := hash + "."
+	for key := range c.memory.keys {
+		if strings.HasPrefix(key, prefix) {
+			c.memory.remove(key)
+			delete(c.data, key)
+		}
+	}
+
+	if c.disk == nil {
+		return
+	}
+	for key := range c.disk.keys {
+		if strings.HasPrefix(key, prefix) {
+			c.disk.remove(key)
+			os.Remove(filepath.Join(c.dir, key))
+		}
+	}
+}
+
+// cacheHash returns the hash the rendering of the paste is cached under, or
+// "" if it shouldn't be cached since the paste is already gone (burned or no
+// views left). Older revisions aren't cached either, only the hash of the
+// latest one is invalidated when the paste is removed.
+func cacheHash(p Response) string {
+	if p.Burn || p.RemainingViews == 0 || p.Outdated {
+		return ""
+	}
+	return p.Sha1
+}
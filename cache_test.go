@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderCacheDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// Files of someone else in the cache dir,
+	for _, name := range []string{"config.json", "notes.txt", "abc.def"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("mine"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newRenderCache(1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(shaPaste("one"), "go", "monokai", nil, rendered{Html: "one"})
+	c.put(shaPaste("two"), "go", "monokai", nil, rendered{Html: "two"})
+
+	// An entry that is picked up again after a restart,
+	c, err = newRenderCache(1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := c.get(shaPaste("two"), "go", "monokai", nil); !ok || r.Html != "two" {
+		t.Fatalf("cached entry : got %+v %v", r, ok)
+	}
+	c.invalidate(shaPaste("two"))
+	c.put(shaPaste("three"), "go", "monokai", nil, rendered{Html: "three"})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := map[string]bool{"config.json": true, "notes.txt": true, "abc.def": true,
+		cacheKey(shaPaste("three"), "go", "monokai", nil): true}
+	if len(names) != len(want) {
+		t.Fatalf("files in cache dir : got %v", names)
+	}
+	for _, name := range names {
+		if !want[name] {
+			t.Fatalf("files in cache dir : got %v", names)
+		}
+	}
+}
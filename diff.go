@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	// Line diffs,
+	"github.com/pmezard/go-difflib/difflib"
+
+	// Routing,
+	"github.com/gorilla/mux"
+)
+
+// diffContext is the number of unchanged lines shown around every change.
+const diffContext = 3
+
+// maxDiffLines is the max number of lines of each side of a diff, the
+// matcher gets slow on really big pastes.
+const maxDiffLines = 20000
+
+// diffSide is one of the pastes (or revisions) in a diff.
+type diffSide struct {
+	Id       string `json:"id"`       // The id of the paste
+	Revision int    `json:"revision"` // The revision of the paste
+	Sha1     string `json:"sha1"`     // The sha1 of the revision
+	Title    string `json:"title"`    // The title of the revision
+	Ref      string `json:"ref"`      // How it's given in the url, id or id@revision
+}
+
+// diffLine is a line of the unified view.
+type diffLine struct {
+	Kind    string `json:"kind"`    // equal, delete or insert
+	OldLine int    `json:"oldline"` // The line number in the old paste, 0 if none
+	NewLine int    `json:"newline"` // The line number in the new paste, 0 if none
+	Text    string `json:"text"`    // The line without its line ending
+}
+
+// diffRow is a row of the side-by-side view.
+type diffRow struct {
+	Kind    string `json:"kind"`    // equal, delete, insert or replace
+	OldLine int    `json:"oldline"` // The line number in the old paste, 0 if none
+	OldText string `json:"oldtext"` // The line of the old paste
+	NewLine int    `json:"newline"` // The line number in the new paste, 0 if none
+	NewText string `json:"newtext"` // The line of the new paste
+}
+
+// diffHunk is a group of changes with the unchanged lines around them.
+type diffHunk struct {
+	Header string     `json:"header"` // Like @@ -1,4 +1,5 @@
+	Lines  []diffLine `json:"lines"`  // The unified view
+	Rows   []diffRow  `json:"rows"`   // The side-by-side view
+}
+
+// Diff is the difference between two pastes, as returned by the api.
+type Diff struct {
+	Old     diffSide   `json:"old"`     // The paste that is diffed from
+	New     diffSide   `json:"new"`     // The paste that is diffed to
+	Added   int        `json:"added"`   // The number of added lines
+	Removed int        `json:"removed"` // The number of removed lines
+	Hunks   []diffHunk `json:"hunks"`   // The changes
+	Unified string     `json:"unified"` // The raw unified diff
+}
+
+// DiffPage is used for generating the diff page.
+type DiffPage struct {
+	Diff       Diff
+	SideBySide bool
+	Title      string
+}
+
+// splitDiffLines splits text into lines without line endings. A trailing
+// newline doesn't start a line of its own.
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// unifiedRange formats a range of lines (start is counted from 0) for a hunk
+// header, the same way as diff -u.
+func unifiedRange(start int, stop int) string {
+	beginning := start + 1
+	length := stop - start
+	if length == 1 {
+		return strconv.Itoa(beginning)
+	}
+	if length == 0 {
+		beginning--
+	}
+	return fmt.Sprintf("%d,%d", beginning, length)
+}
+
+// diffTexts computes the hunks and the raw unified diff between the texts,
+// the names are used in the --- and +++ lines.
+func diffTexts(a string, b string, nameA string, nameB string) ([]diffHunk, string, int, int) {
+
+	linesA := splitDiffLines(a)
+	linesB := splitDiffLines(b)
+
+	// No junk heuristics, repeated lines (like blank lines or braces) are
+	// just as important as any other line in a config dump,
+	m := difflib.NewMatcherWithJunk(linesA, linesB, false, nil)
+
+	var hunks []diffHunk
+	var unified strings.Builder
+	added, removed := 0, 0
+
+	for _, group := range m.GetGroupedOpCodes(diffContext) {
+		first, last := group[0], group[len(group)-1]
+		h := diffHunk{Header: fmt.Sprintf("@@ -%s +%s @@",
+			unifiedRange(first.I1, last.I2), unifiedRange(first.J1, last.J2))}
+
+		for _, c := range group {
+			switch c.Tag {
+			case 'e':
+				for i, j := c.I1, c.J1; i < c.I2; i, j = i+1, j+1 {
+					h.Lines = append(h.Lines, diffLine{"equal", i + 1, j + 1, linesA[i]})
+					h.Rows = append(h.Rows, diffRow{"equal", i + 1, linesA[i], j + 1, linesB[j]})
+				}
+				continue
+			}
+
+			// Everything removed comes before everything added in the
+			// unified view, side by side they're paired up as far as
+			// possible,
+			for i := c.I1; i < c.I2; i++ {
+				h.Lines = append(h.Lines, diffLine{"delete", i + 1, 0, linesA[i]})
+			}
+			for j := c.J1; j < c.J2; j++ {
+				h.Lines = append(h.Lines, diffLine{"insert", 0, j + 1, linesB[j]})
+			}
+			removed += c.I2 - c.I1
+			added += c.J2 - c.J1
+
+			for i, j := c.I1, c.J1; i < c.I2 || j < c.J2; i, j = i+1, j+1 {
+				row := diffRow{Kind: "replace"}
+				if i < c.I2 {
+					row.OldLine, row.OldText = i+1, linesA[i]
+				} else {
+					row.Kind = "insert"
+				}
+				if j < c.J2 {
+					row.NewLine, row.NewText = j+1, linesB[j]
+				} else {
+					row.Kind = "delete"
+				}
+				h.Rows = append(h.Rows, row)
+			}
+		}
+
+		hunks = append(hunks, h)
+	}
+
+	if len(hunks) > 0 {
+		fmt.Fprintf(&unified, "--- %s\n+++ %s\n", nameA, nameB)
+	}
+	prefix := map[string]string{"equal": " ", "delete": "-", "insert": "+"}
+	for _, h := range hunks {
+		unified.WriteString(h.Header + "\n")
+		for _, l := range h.Lines {
+			unified.WriteString(prefix[l.Kind] + l.Text + "\n")
+		}
+	}
+
+	return hunks, unified.String(), added, removed
+}
+
+// getDiff gets both pastes of the diff url and computes the diff. The error
+// is written to the client if any of them isn't available or can't be
+// diffed. Neither paste is burned or has its view counted unless both can be
+// diffed.
+func getDiff(w http.ResponseWriter, r *http.Request) (Diff, bool) {
+
+	vars := mux.Vars(r)
+	var sides [2]Response
+	var refs [2]diffSide
+	var ids [2]string
+	var revs [2]int
+
+	// Both refs must make sense before any paste is looked up,
+	for i, ref := range []string{vars["pasteA"], vars["pasteB"]} {
+		id, rev, err := parsePasteRef(ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return Diff{}, false
+		}
+		ids[i], revs[i] = id, rev
+		refs[i].Ref = ref
+	}
+
+	// The server only has the ciphertext of encrypted pastes, and there are
+	// no lines in binary data,
+	check := func(p Paste, files []File) (int, string) {
+		switch {
+		case p.Binary || p.Encrypted:
+			return http.StatusBadRequest, "Only text pastes can be diffed."
+		case len(files) > 0:
+			return http.StatusBadRequest, "Bundles can't be diffed."
+		case strings.Count(p.Data, "\n") > maxDiffLines:
+			return http.StatusBadRequest, fmt.Sprintf(
+				"Paste %s has too many lines to diff (max %d).", p.Id, maxDiffLines)
+		}
+		return 0, ""
+	}
+
+	// Both sides are checked before either of them is used up,
+	for i := range ids {
+		p := peekPaste(ids[i], revs[i], requestAuth(r, ids[i]), check)
+		if !pasteAvailable(w, r, p, ids[i], false) {
+			return Diff{}, false
+		}
+		sides[i] = p
+	}
+
+	// Then a paste that is burned after reading or has a view limit is read
+	// for real, once even if both sides are revisions of it. The unlock
+	// token from the check saves hashing the password again,
+	for i := range ids {
+		if i == 1 && ids[1] == ids[0] {
+			break
+		}
+		if !sides[i].Burn && sides[i].RemainingViews < 0 {
+			continue
+		}
+		p := getPaste(ids[i], revs[i], pasteAuth{token: sides[i].Unlock}, check)
+		if !pasteAvailable(w, r, p, ids[i], false) {
+			return Diff{}, false
+		}
+		sides[i] = p
+	}
+
+	for i, p := range sides {
+		refs[i] = diffSide{Id: ids[i], Revision: p.Revision, Sha1: p.Sha1,
+			Title: p.Title, Ref: refs[i].Ref}
+	}
+
+	loggy(fmt.Sprintf("Diffing '%s' against '%s'.", refs[0].Ref, refs[1].Ref))
+
+	d := Diff{Old: refs[0], New: refs[1]}
+	d.Hunks, d.Unified, d.Added, d.Removed = diffTexts(sides[0].Paste,
+		sides[1].Paste, fmt.Sprintf("%s@%d", refs[0].Id, refs[0].Revision),
+		fmt.Sprintf("%s@%d", refs[1].Id, refs[1].Revision))
+	return d, true
+}
+
+// DiffHandler generates the diff page, unified or (with ?view=side) side by
+// side.
+func DiffHandler(w http.ResponseWriter, r *http.Request) {
+
+	d, ok := getDiff(w, r)
+	if !ok {
+		return
+	}
+
+	page := &DiffPage{
+		Diff:       d,
+		SideBySide: r.URL.Query().Get("view") == "side",
+		Title:      fmt.Sprintf("Diff of %s and %s", d.Old.Title, d.New.Title),
+	}
+
+	err := templates.ExecuteTemplate(w, "diff.html", page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DiffAPIHandler returns the diff as json.
+func DiffAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	d, ok := getDiff(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DiffRawHandler returns the raw unified diff as a download.
+func DiffRawHandler(w http.ResponseWriter, r *http.Request) {
+
+	d, ok := getDiff(w, r)
+	if !ok {
+		return
+	}
+
+	name := fmt.Sprintf("%s_%s.diff", d.Old.Ref, d.New.Ref)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name}))
+	w.Header().Set("Content-Type", "text/x-diff; charset=UTF-8")
+	io.WriteString(w, d.Unified)
+}
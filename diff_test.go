@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDiffTexts(t *testing.T) {
+
+	_, unified, added, removed := diffTexts("a\nb\nc\n", "a\nB\nc\nd\n", "old", "new")
+	if added != 2 || removed != 1 {
+		t.Fatalf("added %d and removed %d", added, removed)
+	}
+	for _, want := range []string{"--- old", "+++ new", "-b", "+B", "+d"} {
+		if !strings.Contains(unified, want) {
+			t.Fatalf("%q missing in %s", want, unified)
+		}
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "one\ntwo\n"})
+	w := do("PUT", "/api/"+saved.Id, `{"paste": "one\nthree\n", "delkey": "`+
+		saved.DelKey+`"}`, map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit : got %d", w.Code)
+	}
+
+	w = do("GET", "/diff/"+saved.Id+"@1/"+saved.Id+"@2/raw", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("diff : got %d (%s)", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "-two") || !strings.Contains(w.Body.String(), "+three") {
+		t.Fatalf("diff : got %s", w.Body.String())
+	}
+
+	if w := do("GET", "/diff/"+saved.Id+"@1/"+saved.Id+"@2", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("diff page : got %d", w.Code)
+	}
+	if w := do("GET", "/diff/"+saved.Id+"@x/"+saved.Id, "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad revision : got %d", w.Code)
+	}
+	if w := do("GET", "/diff/"+saved.Id+"/missing", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing paste : got %d", w.Code)
+	}
+}
+
+func TestDiffBurn(t *testing.T) {
+	resetStore()
+
+	// A diff that fails on the other side leaves the burn paste alone,
+	burn := save(t, map[string]interface{}{"paste": "secret\n", "burn": true})
+	if w := do("GET", "/diff/"+burn.Id+"/missing", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing other side : got %d", w.Code)
+	}
+	if w := do("GET", "/diff/"+burn.Id+"/"+burn.Id+"@x", "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad other side : got %d", w.Code)
+	}
+
+	// Diffing it against itself reads it once,
+	if w := do("GET", "/diff/"+burn.Id+"/"+burn.Id+"/raw", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("diff against itself : got %d (%s)", w.Code, w.Body.String())
+	}
+	if code, _ := raw(burn.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("after the diff : got %d", code)
+	}
+}
+
+func TestDiffMaxViews(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "one\n", "maxviews": "2"})
+	w := do("PUT", "/api/"+saved.Id, `{"paste": "two\n", "delkey": "`+
+		saved.DelKey+`"}`, map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit : got %d", w.Code)
+	}
+
+	if w := do("GET", "/diff/"+saved.Id+"/missing", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing other side : got %d", w.Code)
+	}
+
+	// Both revisions of the paste take a single view,
+	w = do("GET", "/diff/"+saved.Id+"@1/"+saved.Id+"@2/raw", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "+two") {
+		t.Fatalf("diff : got %d (%s)", w.Code, w.Body.String())
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusOK {
+		t.Fatalf("last view : got %d", code)
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("no views left : got %d", code)
+	}
+}
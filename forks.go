@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// forkParent resolves the parent given when a fork is saved (id or
+// id@revision) to the id and revision of an existing paste. Returns "" if
+// there is no such paste, the fork is saved anyway but without the link.
+func forkParent(ref string) (string, int) {
+
+	if ref == "" {
+		return "", 0
+	}
+
+	id, rev, err := parsePasteRef(ref)
+	if err != nil {
+		loggy(fmt.Sprintf("Ignoring the parent '%s' : %s", ref, err))
+		return "", 0
+	}
+
+	p, err := store.Get(id)
+	switch {
+	case err == ErrNotFound:
+		loggy(fmt.Sprintf("Ignoring the parent '%s', it doesn't exist.", ref))
+		return "", 0
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	if !checkPasteExpiry(id, p.Expiry) || rev > p.Revision {
+		loggy(fmt.Sprintf("Ignoring the parent '%s', it doesn't exist.", ref))
+		return "", 0
+	}
+
+	if rev == 0 {
+		rev = p.Revision
+	}
+	return id, rev
+}
+
+// forkList returns the ids of the forks of the paste that anyone may know
+// about. Forks that are burned after reading, has a view limit or a password
+// are left out, listing them would give them away.
+func forkList(pasteId string) []string {
+
+	forks, err := store.Forks(pasteId)
+	if err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	var ids []string
+	for _, p := range forks {
+		if p.Burn || p.MaxViews > 0 || p.Password != "" {
+			continue
+		}
+		if checkPasteExpiry(p.Id, p.Expiry) {
+			ids = append(ids, p.Id)
+		}
+	}
+	return ids
+}
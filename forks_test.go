@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForks(t *testing.T) {
+	resetStore()
+
+	parent := save(t, map[string]interface{}{"paste": "original\n"})
+	fork := save(t, map[string]interface{}{"paste": "original\n", "parent": parent.Id})
+	if fork.Id == parent.Id || fork.Parent != parent.Id || fork.ParentRevision != 1 {
+		t.Fatalf("fork : got %+v", fork)
+	}
+
+	// Forks that would give away a secret paste aren't listed, and a parent
+	// that doesn't exist is dropped,
+	save(t, map[string]interface{}{"paste": "hidden\n", "parent": parent.Id,
+		"password": "hunter2"})
+	orphan := save(t, map[string]interface{}{"paste": "orphan\n", "parent": "missing"})
+	if orphan.Parent != "" {
+		t.Fatalf("orphan : got parent %q", orphan.Parent)
+	}
+
+	w := do("GET", "/api/"+parent.Id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("api : got %d", w.Code)
+	}
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Forks) != 1 || p.Forks[0] != fork.Id {
+		t.Fatalf("forks : got %v", p.Forks)
+	}
+}
+
+func TestForkOfGoneParent(t *testing.T) {
+	resetStore()
+
+	now := time.Now().Unix()
+	if err := store.Save(Paste{Id: "expired", Hash: "a", Data: "old\n", Expiry: now - 10,
+		Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	fork := save(t, map[string]interface{}{"paste": "old\n", "parent": "expired"})
+	if fork.Parent != "" {
+		t.Fatalf("fork of an expired paste : got parent %q", fork.Parent)
+	}
+
+	// Naming a burn paste as the parent doesn't read it, once it's read
+	// it's gone and later forks lose the link,
+	burn := save(t, map[string]interface{}{"paste": "secret\n", "burn": true})
+	fork = save(t, map[string]interface{}{"paste": "fork of secret\n", "parent": burn.Id})
+	if fork.Parent != burn.Id {
+		t.Fatalf("fork of an unread burn paste : got parent %q", fork.Parent)
+	}
+	if code, body := raw(burn.Id, nil); code != http.StatusOK || body != "secret\n" {
+		t.Fatalf("burn paste after the fork : got %d %q", code, body)
+	}
+	fork = save(t, map[string]interface{}{"paste": "late fork\n", "parent": burn.Id})
+	if fork.Parent != "" {
+		t.Fatalf("fork of a burned paste : got parent %q", fork.Parent)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	// Syntax highlighting,
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// defaultHighlightTimeout is used when highlighttimeout isn't set in
+// config.json.
+const defaultHighlightTimeout = 5
+
+// highlightSlots limits the number of pastes that are highlighted at the same
+// time, a slot is taken by sending to it. The size is set by highlightworkers
+// in config.json and defaults to the number of cpus.
+var highlightSlots chan struct{}
+
+// Language is a language supported by a highlighter.
+type Language struct {
+	DisplayName string   `json:"displayname"` // The name shown to the user
+	Alias       string   `json:"alias"`       // The name given to Render
+	Extensions  []string `json:"extensions"`  // File name patterns, like *.go
+	Prioritized bool     `json:"prioritized"` // If it's listed in assets/prio-lexers
+}
+
+// Highlighter is an engine that turns a paste into highlighted html.
+type Highlighter interface {
+	// ListLanguages returns the supported languages.
+	ListLanguages() ([]Language, error)
+
+	// ListStyles returns the names of the supported styles.
+	ListStyles() ([]string, error)
+
+	// Render highlights src, with the lines in hl highlighted a bit more.
+	// Returns the html, the language that was actually used (which differs
+	// from lang when it was autodetected) and a message that is shown to the
+	// user.
+	Render(ctx context.Context, src string, lang string, style string, hl []lineRange) (string, string, string, error)
+}
+
+// newHighlighter returns the highlighter engine named in config.json,
+// chroma (the default), pygments or plain. The chroma engine falls back to
+// the highlighter-wrapper (if one is configured) for languages and styles it
+// doesn't know.
+func newHighlighter(engine string, wrapper string) (Highlighter, error) {
+
+	switch engine {
+	case "", "chroma":
+		h := &chromaHighlighter{}
+		if wrapper != "" {
+			h.fallback = &pygmentsHighlighter{wrapper: wrapper}
+		}
+		return h, nil
+
+	case "pygments":
+		if wrapper == "" {
+			return nil, fmt.Errorf("the pygments engine needs highlighter to be set")
+		}
+		return &pygmentsHighlighter{wrapper: wrapper}, nil
+
+	case "plain":
+		return plainHighlighter{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown highlight engine '%s'", engine)
+}
+
+// setHighlightLimits fills in the defaults of the highlight limits that
+// aren't set in the configuration, and sets up the slots.
+func setHighlightLimits(c *Configuration) {
+
+	if c.HighlightTimeout <= 0 {
+		c.HighlightTimeout = defaultHighlightTimeout
+	}
+	if c.HighlightWorkers <= 0 {
+		c.HighlightWorkers = runtime.NumCPU()
+	}
+
+	loggy(fmt.Sprintf("Highlighting at most %d pastes at once, %d seconds each",
+		c.HighlightWorkers, c.HighlightTimeout))
+	highlightSlots = make(chan struct{}, c.HighlightWorkers)
+}
+
+// renderLimited renders the paste with the highlighter once a slot is free.
+// Gives up with the error of the context when it's done, either while waiting
+// for a slot or while rendering. The slot isn't handed back until the
+// highlighter has actually returned, so an engine that doesn't stop at once
+// still counts against the limit.
+func renderLimited(ctx context.Context, src string, lang string, style string, hl []lineRange) (string, string, string, error) {
+
+	select {
+	case highlightSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", lang, "", ctx.Err()
+	}
+
+	type result struct {
+		html, lang, msg string
+		err             error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-highlightSlots }()
+		out, used, msg, err := highlighter.Render(ctx, src, lang, style, hl)
+		done <- result{out, used, msg, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() != nil {
+			return "", lang, "", ctx.Err()
+		}
+		return r.html, r.lang, r.msg, r.err
+	case <-ctx.Done():
+		return "", lang, "", ctx.Err()
+	}
+}
+
+// defaultLineHighlight is the background of highlighted lines when the style
+// doesn't have one of its own.
+const defaultLineHighlight = "#ffffcc"
+
+// highlightLines wraps the lines in hl in a span with the given background.
+// The line endings are kept outside of the spans.
+func highlightLines(lines []string, hl []lineRange, background string) string {
+
+	var out strings.Builder
+	for i, line := range lines {
+		code, nl := strings.CutSuffix(line, "\n")
+		if inLineRanges(i+1, hl) {
+			fmt.Fprintf(&out, `<span class="hll" style="background-color: %s">%s</span>`,
+				background, code)
+		} else {
+			out.WriteString(code)
+		}
+		if nl {
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+// highlightTable lays out the line numbers and the code the same way as the
+// pygments html-formatter does (a table with the line numbers in the first
+// pre and the code in the second) since the frontend depends on it.
+func highlightTable(lines int, code string, css string) string {
+
+	var numbers strings.Builder
+	for i := 1; i <= lines; i++ {
+		if i > 1 {
+			numbers.WriteString("\n")
+		}
+		fmt.Fprintf(&numbers, "%d", i)
+	}
+
+	return `<table class="highlighttable"><tr><td class="linenos">` +
+		`<div class="linenodiv"><pre>` + numbers.String() + `</pre></div></td>` +
+		`<td class="code"><div class="highlight" style="` + css + `"><pre>` +
+		code + `</pre></div></td></tr></table>`
+}
+
+// chromaHighlighter is the built-in engine, based on chroma.
+type chromaHighlighter struct {
+	fallback Highlighter // Used for languages and styles chroma doesn't know
+}
+
+// lexerAlias returns the name the lexer is listed with in ListLanguages.
+func lexerAlias(lexer chroma.Lexer) string {
+	if c := lexer.Config(); len(c.Aliases) > 0 {
+		return c.Aliases[0]
+	}
+	return strings.ToLower(lexer.Config().Name)
+}
+
+// knows reports whether chroma has both a lexer for lang and the style.
+func (h *chromaHighlighter) knows(lang string, style string) bool {
+	_, ok := styles.Registry[style]
+	return ok && (lang == "autodetect" || lexers.Get(lang) != nil)
+}
+
+// ListLanguages returns the languages of chroma, and the ones that are only
+// known by the fallback.
+func (h *chromaHighlighter) ListLanguages() ([]Language, error) {
+
+	var langs []Language
+	known := make(map[string]bool)
+	for _, l := range lexers.GlobalLexerRegistry.Lexers {
+		c := l.Config()
+		langs = append(langs, Language{
+			DisplayName: strings.Title(c.Name),
+			Alias:       lexerAlias(l),
+			Extensions:  c.Filenames,
+		})
+		known[strings.Title(c.Name)] = true
+	}
+
+	if h.fallback != nil {
+		more, err := h.fallback.ListLanguages()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range more {
+			if !known[l.DisplayName] {
+				langs = append(langs, l)
+			}
+		}
+	}
+
+	return langs, nil
+}
+
+// ListStyles returns the styles of chroma, and the ones that are only known by
+// the fallback.
+func (h *chromaHighlighter) ListStyles() ([]string, error) {
+
+	list := styles.Names()
+	if h.fallback != nil {
+		more, err := h.fallback.ListStyles()
+		if err != nil {
+			return nil, err
+		}
+		for _, style := range more {
+			if _, ok := styles.Registry[style]; !ok {
+				list = append(list, style)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// lexer returns the lexer to use for the paste and the language it stands
+// for. If lang is autodetect (or not found) the lexer is guessed from the
+// paste. The lexer is nil if none could be found. The message is the one that
+// is shown to the user.
+func (h *chromaHighlighter) lexer(src string, lang string) (chroma.Lexer, string, string) {
+
+	if lang != "autodetect" {
+		if lexer := lexers.Get(lang); lexer != nil {
+			return lexer, lang,
+				"Successfully used lexer for given language :: " + lang
+		}
+	}
+
+	lexer := lexers.Analyse(src)
+	if lexer == nil {
+		if lang == "autodetect" {
+			return nil, lang,
+				"Could not autodetect language (returning plain text).\n"
+		}
+		return nil, lang, "Given language was not found :: '" + lang +
+			"' (returning plain text).\n"
+	}
+
+	guessed := lexerAlias(lexer)
+	msg := "Lexer guessed :: " + guessed
+	if lang != "autodetect" {
+		msg += " (although given language was " + lang + ") "
+	}
+	return lexer, guessed, msg
+}
+
+// Render highlights src with chroma, or with the fallback if chroma doesn't
+// know the language or style.
+func (h *chromaHighlighter) Render(ctx context.Context, src string, lang string, style string, hl []lineRange) (string, string, string, error) {
+
+	if h.fallback != nil && !h.knows(lang, style) {
+		loggy(fmt.Sprintf("Chroma doesn't know '%s' or '%s', using the fallback",
+			lang, style))
+		return h.fallback.Render(ctx, src, lang, style, hl)
+	}
+
+	lexer, lang, msg := h.lexer(src, lang)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, src)
+	if err != nil {
+		return "", lang, "", err
+	}
+
+	// Lexing is where the time goes, so check if we still have time left
+	// every now and then,
+	var tokens []chroma.Token
+	for t := iterator(); t != chroma.EOF; t = iterator() {
+		tokens = append(tokens, t)
+		if len(tokens)%1000 == 0 && ctx.Err() != nil {
+			return "", lang, "", ctx.Err()
+		}
+	}
+
+	s := styles.Get(style)
+	bg := s.Get(chroma.Background)
+
+	lines := chroma.SplitTokensIntoLines(tokens)
+	code := make([]string, len(lines))
+	for i, line := range lines {
+		var b strings.Builder
+		for _, t := range line {
+			css := chromahtml.StyleEntryToCSS(s.Get(t.Type).Sub(bg))
+			if css == "" {
+				b.WriteString(html.EscapeString(t.Value))
+				continue
+			}
+			fmt.Fprintf(&b, `<span style="%s">%s</span>`, css,
+				html.EscapeString(t.Value))
+		}
+		code[i] = b.String()
+	}
+
+	background := defaultLineHighlight
+	if e := s.Get(chroma.LineHighlight); e.Background.IsSet() {
+		background = e.Background.String()
+	}
+
+	return highlightTable(len(lines), highlightLines(code, hl, background),
+		chromahtml.StyleEntryToCSS(bg)), lang, msg, nil
+}
+
+// pygmentsHighlighter runs the highlighter-wrapper (which in turn uses
+// pygments) in a separate process.
+type pygmentsHighlighter struct {
+	wrapper string // The path to the highlighter-wrapper
+}
+
+// ListLanguages asks the wrapper for its lexers, which are printed as
+// "description;lexer;filenames", one per line. Older wrappers doesn't print
+// the (comma separated) filenames.
+func (h *pygmentsHighlighter) ListLanguages() ([]Language, error) {
+
+	out, err := exec.Command(h.wrapper, "getlexers").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var langs []Language
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+
+		s := strings.Split(line, ";")
+		if len(s) != 2 && len(s) != 3 {
+			return nil, fmt.Errorf("could not split '%v' from %s (fields should be seperated by ;)",
+				s, h.wrapper)
+		}
+
+		l := Language{DisplayName: strings.Title(s[0]), Alias: s[1]}
+		if len(s) == 3 && s[2] != "" {
+			l.Extensions = strings.Split(s[2], ",")
+		}
+		langs = append(langs, l)
+	}
+
+	return langs, nil
+}
+
+// ListStyles asks the wrapper for its styles, which are printed one per line.
+func (h *pygmentsHighlighter) ListStyles() ([]string, error) {
+
+	out, err := exec.Command(h.wrapper, "getstyles").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			list = append(list, line)
+		}
+	}
+
+	return list, nil
+}
+
+// Render runs src through the wrapper, the html is read from stdout and the
+// message from stderr. The highlighted lines are given as a third argument.
+func (h *pygmentsHighlighter) Render(ctx context.Context, src string, lang string, style string, hl []lineRange) (string, string, string, error) {
+
+	args := []string{lang, style}
+	if len(hl) > 0 {
+		args = append(args, formatLineRanges(hl))
+	}
+
+	loggy(fmt.Sprintf("Executing command : %s %s", h.wrapper, strings.Join(args, " ")))
+	cmd := exec.CommandContext(ctx, h.wrapper, args...)
+	cmd.Stdin = strings.NewReader(src)
+
+	// Kill the whole process group when we run out of time, pygments may
+	// have started processes of its own,
+	killProcessGroup(cmd)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", lang, "", fmt.Errorf("%s (%s)", err, stderr.String())
+	}
+
+	// The wrapper tells if it guessed the language, a message without the
+	// name of it leaves the language as it was,
+	msg := stderr.String()
+	if guessed, ok := strings.CutPrefix(msg, "Lexer guessed :: "); ok {
+		if fields := strings.Fields(guessed); len(fields) > 0 {
+			lang = fields[0]
+		}
+	}
+
+	return stdout.String(), lang, msg, nil
+}
+
+// plainHighlighter doesn't highlight at all, it just escapes the paste and
+// adds line numbers.
+type plainHighlighter struct{}
+
+// ListLanguages returns no languages, everything is plain text.
+func (plainHighlighter) ListLanguages() ([]Language, error) {
+	return nil, nil
+}
+
+// ListStyles returns no styles, there is nothing to style.
+func (plainHighlighter) ListStyles() ([]string, error) {
+	return nil, nil
+}
+
+// Render returns the escaped src with line numbers.
+func (plainHighlighter) Render(ctx context.Context, src string, lang string, style string, hl []lineRange) (string, string, string, error) {
+
+	lines := strings.SplitAfter(html.EscapeString(src), "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return highlightTable(len(lines), highlightLines(lines, hl, defaultLineHighlight), ""), "text",
+		"Highlighting is turned off (returning plain text).", nil
+}
@@ -6,7 +6,15 @@ from pygments.lexers import get_lexer_by_name, guess_lexer
 from pygments.formatters import HtmlFormatter
 import sys
 
-def render(code, lang, theme):
+def hl_lines(ranges):
+
+    lines = []
+    for part in ranges.split(","):
+        first, _, last = part.partition("-")
+        lines += range(int(first), int(last or first) + 1)
+    return lines
+
+def render(code, lang, theme, hl=[]):
 
     guess = ""
     lang_org = lang
@@ -25,7 +33,7 @@ def render(code, lang, theme):
                 out = "Given language was not found :: '"+lang+"' (returning plain text).\n"
 
             lexer = get_lexer_by_name("text")
-            html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", encoding="utf-8")
+            html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", hl_lines=hl, encoding="utf-8")
             return highlight(code, lexer, html_format),out
 
     if guess:
@@ -36,9 +44,9 @@ def render(code, lang, theme):
         out = "Successfully used lexer for given language :: "+lang
 
     try:
-        html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", encoding="utf-8")
+        html_format = HtmlFormatter(style=theme, noclasses="true", linenos="true", hl_lines=hl, encoding="utf-8")
     except:
-        html_format = HtmlFormatter(noclasses="true", linenos="true", encoding="utf-8")
+        html_format = HtmlFormatter(noclasses="true", linenos="true", hl_lines=hl, encoding="utf-8")
 
     return highlight(code, lexer, html_format),out
 
@@ -50,14 +58,15 @@ def usage(err=0):
     print("      It will read data on stdin and simply print it on stdout")
 
     print("\n Usage, \n")
-    print("    - %s [lang] [style] < FILE" % sys.argv[0])
+    print("    - %s [lang] [style] [lines] < FILE" % sys.argv[0])
     print("    - %s getlexers" % sys.argv[0])
     print("    - %s getstyles" % sys.argv[0])
 
     print("\n Where, \n")
     print("    - lang is the language of your code")
     print("    - style is the 'theme' for the formatter")
-    print("    - getlexers will print available lexers (displayname;lexer-name)")
+    print("    - lines is the lines to highlight, like 10-20,30 (optional)")
+    print("    - getlexers will print available lexers (displayname;lexer-name;filenames)")
     print("    - getstyles will print available styles \n")
 
     sys.exit(err)
@@ -72,7 +81,7 @@ def get_lexers():
     item = pygments.lexers.get_all_lexers()
     for items in item:
         try:
-            print(items[0]+";"+items[1][0])
+            print(items[0]+";"+items[1][0]+";"+",".join(items[2]))
         except IndexError:
             continue
     sys.exit(0)
@@ -91,9 +100,15 @@ if len(sys.argv) >= 2:
       if arg == 'getstyles':
           get_styles()
 
-if len(sys.argv) == 3:
+hl = []
+if len(sys.argv) == 3 or len(sys.argv) == 4:
     lang  = sys.argv[1]
     theme = sys.argv[2]
+    if len(sys.argv) == 4:
+        try:
+            hl = hl_lines(sys.argv[3])
+        except ValueError:
+            usage(1)
 else:
     usage(1);
 
@@ -101,7 +116,7 @@ if not sys.stdin.isatty():
     for line in sys.stdin:
         code += line
 
-    out, stderr = render(code, lang, theme)
+    out, stderr = render(code, lang, theme, hl)
     sys.stdout.buffer.write(out)
     sys.stderr.write(stderr)
 else:
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxLineRanges is the max number of ranges accepted in a ?hl= or ?lines=.
+const maxLineRanges = 20
+
+// lineRange is a range of lines, both ends included and counted from 1.
+type lineRange struct {
+	first int
+	last  int
+}
+
+// parseLineRanges parses a comma separated list of line numbers and ranges,
+// like "10-20" or "3,7-9".
+func parseLineRanges(s string) ([]lineRange, error) {
+
+	var ranges []lineRange
+	for _, part := range strings.Split(s, ",") {
+		if len(ranges) == maxLineRanges {
+			return nil, fmt.Errorf("too many line ranges (max %d)", maxLineRanges)
+		}
+
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			last = first
+		}
+
+		a, err1 := strconv.Atoi(first)
+		b, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || a < 1 || b < a {
+			return nil, fmt.Errorf("invalid line range '%s'", part)
+		}
+		ranges = append(ranges, lineRange{a, b})
+	}
+
+	return ranges, nil
+}
+
+// formatLineRanges is the inverse of parseLineRanges.
+func formatLineRanges(ranges []lineRange) string {
+	var parts []string
+	for _, r := range ranges {
+		parts = append(parts, fmt.Sprintf("%d-%d", r.first, r.last))
+	}
+	return strings.Join(parts, ",")
+}
+
+// inLineRanges reports whether line n is in any of the ranges.
+func inLineRanges(n int, ranges []lineRange) bool {
+	for _, r := range ranges {
+		if n >= r.first && n <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// selectLines returns only the lines of text that are in the ranges, with
+// their line endings.
+func selectLines(text string, ranges []lineRange) string {
+
+	var out strings.Builder
+	for i, line := range strings.SplitAfter(text, "\n") {
+		if inLineRanges(i+1, ranges) {
+			out.WriteString(line)
+		}
+	}
+	return out.String()
+}
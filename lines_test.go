@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseLineRanges(t *testing.T) {
+
+	ranges, err := parseLineRanges("3, 7-9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatLineRanges(ranges); got != "3-3,7-9" {
+		t.Fatalf("got %q", got)
+	}
+	if !inLineRanges(8, ranges) || inLineRanges(5, ranges) {
+		t.Fatalf("wrong lines in %v", ranges)
+	}
+
+	for _, bad := range []string{"", "0", "x", "5-2", "1-", "-3",
+		"1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21"} {
+		if _, err := parseLineRanges(bad); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestRawLines(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "one\ntwo\nthree\nfour\n"})
+
+	w := do("GET", "/raw/"+saved.Id+"?lines=2-3", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "two\nthree\n" {
+		t.Fatalf("lines : got %d %q", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/raw/"+saved.Id+"?lines=3-1", "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad lines : got %d", w.Code)
+	}
+}
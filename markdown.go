@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"time"
+
+	// Markdown rendering and sanitizing,
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdownMode is the render mode (?render=markdown) that shows the paste as
+// formatted markdown instead of highlighted source.
+const markdownMode = "markdown"
+
+// markdownCacheLang is the language markdown renderings are cached under, it
+// can't clash with a real language.
+const markdownCacheLang = "!markdown"
+
+// markdownPolicy is what's left of the html after rendering. User content
+// policy, plus the check boxes of task lists and the classes and inline styles
+// the highlighters use for the fenced code blocks. Only the classes of the
+// highlighter table are allowed, so a paste can't borrow the classes (and the
+// layout) of the page around it.
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^highlighttable$`)).
+		OnElements("table")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(linenos|code)$`)).
+		OnElements("td")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(linenodiv|highlight)$`)).
+		OnElements("div")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(hll|normal|special)$`)).
+		OnElements("span")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowStyles("color", "background-color", "font-weight", "font-style",
+		"text-decoration", "border").Globally()
+	return p
+}()
+
+// fencedCodeRenderer renders fenced code blocks with the configured
+// highlighter, all of them under the same deadline.
+type fencedCodeRenderer struct {
+	ctx   context.Context
+	style string
+}
+
+// RegisterFuncs takes over the fenced code blocks from the html renderer.
+func (r *fencedCodeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCode)
+}
+
+// renderFencedCode highlights the block in the language given after the
+// fence, or as plain text if none is given.
+func (r *fencedCodeRenderer) renderFencedCode(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*ast.FencedCodeBlock)
+	var code bytes.Buffer
+	for i := 0; i < n.Lines().Len(); i++ {
+		line := n.Lines().At(i)
+		code.Write(line.Value(source))
+	}
+
+	lang := "text"
+	if l := n.Language(source); len(l) > 0 {
+		lang = string(l)
+	}
+
+	out, _, _, err := renderLimited(r.ctx, code.String(), lang, r.style, nil)
+	if err != nil {
+		loggy(fmt.Sprintf("Could not highlight fenced code block, returning text. Error : %s", err))
+		out = "<pre>" + html.EscapeString(code.String()) + "</pre>"
+	}
+
+	w.WriteString(out)
+	return ast.WalkSkipChildren, nil
+}
+
+// renderMarkdown renders the paste as GitHub flavored markdown and sanitizes
+// the result. The hash is the same as for high, "" if the result shouldn't be
+// cached. Returns the html, a message for the user and the style that was
+// used for the code blocks.
+func renderMarkdown(hash string, paste string, style string) (string, string, string) {
+
+	if style == "" {
+		style = "manni"
+	}
+
+	if hash != "" {
+		if c, ok := pasteCache.get(hash, markdownCacheLang, style, nil); ok {
+			loggy("Returning the rendered markdown from the cache.")
+			return c.Html, c.Extra, c.Style
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(configuration.HighlightTimeout)*time.Second)
+	defer cancel()
+
+	md := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(
+			util.Prioritized(&fencedCodeRenderer{ctx: ctx, style: style}, 100))),
+	)
+
+	var out bytes.Buffer
+	if err := md.Convert([]byte(paste), &out); err != nil {
+		loggy(fmt.Sprintf("Could not render markdown, returning text. Error : %s", err))
+		return "<pre>" + html.EscapeString(paste) + "</pre>",
+			"Could not render markdown, returning plain text.", style
+	}
+
+	body := `<div class="markdown-body">` +
+		markdownPolicy.Sanitize(out.String()) + `</div>`
+	msg := "Rendered as markdown."
+	if ctx.Err() != nil {
+		msg = "Rendered as markdown, some code blocks took too long to highlight."
+	}
+
+	// Only complete renderings are cached,
+	if hash != "" && ctx.Err() == nil {
+		pasteCache.put(hash, markdownCacheLang, style, nil,
+			rendered{body, msg, markdownCacheLang, style})
+	}
+	return body, msg, style
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+
+	out, _, _ := renderMarkdown("", "# Title\n\n- [x] done\n\n```go\npackage main\n```\n", "monokai")
+
+	for _, want := range []string{"<h1", "Title", `type="checkbox"`,
+		`class="highlighttable"`, `class="linenos"`, `class="highlight"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("%q missing in %s", want, out)
+		}
+	}
+}
+
+func TestMarkdownPolicy(t *testing.T) {
+
+	out := markdownPolicy.Sanitize(
+		`<div class="navbar fixed-top" style="display: block; color: red">x</div>` +
+			`<span class="hll swal-overlay">y</span><span class="hll">z</span>` +
+			`<table class="highlighttable"><tr><td class="code">c</td></tr></table>` +
+			`<a href="javascript:alert(1)" class="btn">a</a><script>alert(1)</script>`)
+
+	for _, bad := range []string{"navbar", "fixed-top", "display", "swal-overlay",
+		"<script", "javascript:", "btn"} {
+		if strings.Contains(out, bad) {
+			t.Fatalf("%q left in %s", bad, out)
+		}
+	}
+	for _, want := range []string{"color: red", `<span class="hll">z`,
+		`class="highlighttable"`, `class="code"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("%q missing in %s", want, out)
+		}
+	}
+}
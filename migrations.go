@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is a single versioned change of the database schema. The up
+// statements are keyed by dbtype, the "" key is used for every dbtype that
+// doesn't have statements of its own. Every occurrence of {table} is replaced
+// with the configured dbtable. Changes of the data that can't be expressed in
+// plain sql goes in run, which is called after the statements.
+type migration struct {
+	version     int
+	description string
+	up          map[string][]string
+	run         func(tx *sql.Tx, dbType string, table string) error
+}
+
+// migrationLockTimeout is how many seconds an instance waits for another
+// one to finish migrating a MySQL database.
+const migrationLockTimeout = 300
+
+// migrations holds all schema changes in the order they are applied. Never
+// change or remove a migration that has been released, add a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create paste table",
+		up: map[string][]string{
+			"sqlite3": {`CREATE TABLE IF NOT EXISTS {table} (
+				id varchar(30) NOT NULL PRIMARY KEY,
+				title varchar(50) default NULL,
+				hash char(40) default NULL,
+				data text,
+				delkey char(40) default NULL,
+				expiry integer)`},
+			"postgres": {`CREATE TABLE IF NOT EXISTS {table} (
+				id varchar(30) NOT NULL PRIMARY KEY,
+				title varchar(50) default NULL,
+				hash char(40) default NULL,
+				data text,
+				delkey char(40) default NULL,
+				expiry bigint)`},
+			"mysql": {"CREATE TABLE IF NOT EXISTS `{table}` (" + `
+				id varchar(30) NOT NULL PRIMARY KEY,
+				title varchar(50) default NULL,
+				hash char(40) default NULL,
+				data longtext,
+				delkey char(40) default NULL,
+				expiry bigint)`},
+		},
+	},
+	{
+		version:     2,
+		description: "index paste hashes",
+		up: map[string][]string{
+			"": {"CREATE INDEX {table}_hash_idx ON {table} (hash)"},
+		},
+	},
+	{
+		version:     3,
+		description: "index paste expiry dates",
+		up: map[string][]string{
+			"": {"CREATE INDEX {table}_expiry_idx ON {table} (expiry)"},
+		},
+	},
+	{
+		version:     4,
+		description: "add burn after reading flag",
+		up: map[string][]string{
+			"postgres": {"ALTER TABLE {table} ADD COLUMN burn boolean NOT NULL DEFAULT false"},
+			"":         {"ALTER TABLE {table} ADD COLUMN burn boolean NOT NULL DEFAULT 0"},
+		},
+	},
+	{
+		version:     5,
+		description: "add view limit and counter",
+		up: map[string][]string{
+			"": {
+				"ALTER TABLE {table} ADD COLUMN max_views integer NOT NULL DEFAULT 0",
+				"ALTER TABLE {table} ADD COLUMN views integer NOT NULL DEFAULT 0",
+			},
+		},
+	},
+	{
+		version:     6,
+		description: "add client side encryption flag",
+		up: map[string][]string{
+			"postgres": {"ALTER TABLE {table} ADD COLUMN encrypted boolean NOT NULL DEFAULT false"},
+			"":         {"ALTER TABLE {table} ADD COLUMN encrypted boolean NOT NULL DEFAULT 0"},
+		},
+	},
+	{
+		version:     7,
+		description: "add password hash",
+		up: map[string][]string{
+			"": {"ALTER TABLE {table} ADD COLUMN password varchar(60) default NULL"},
+		},
+	},
+	{
+		version:     8,
+		description: "unescape html escaped titles and data",
+		run:         unescapePastes,
+	},
+	{
+		version:     9,
+		description: "add mime type and binary data",
+		up: map[string][]string{
+			"sqlite3": {
+				"ALTER TABLE {table} ADD COLUMN mime varchar(100) default NULL",
+				"ALTER TABLE {table} ADD COLUMN bin blob",
+			},
+			"postgres": {
+				"ALTER TABLE {table} ADD COLUMN mime varchar(100) default NULL",
+				"ALTER TABLE {table} ADD COLUMN bin bytea",
+			},
+			"mysql": {
+				"ALTER TABLE {table} ADD COLUMN mime varchar(100) default NULL",
+				"ALTER TABLE {table} ADD COLUMN bin longblob",
+			},
+		},
+	},
+	{
+		version:     10,
+		description: "add language and style",
+		up: map[string][]string{
+			"": {
+				"ALTER TABLE {table} ADD COLUMN lang varchar(50) default NULL",
+				"ALTER TABLE {table} ADD COLUMN style varchar(50) default NULL",
+			},
+		},
+	},
+	{
+		version:     11,
+		description: "add file name",
+		up: map[string][]string{
+			"": {"ALTER TABLE {table} ADD COLUMN filename varchar(255) default NULL"},
+		},
+	},
+	{
+		version:     12,
+		description: "add revisions",
+		up: map[string][]string{
+			"mysql": {
+				"ALTER TABLE {table} ADD COLUMN revision integer NOT NULL DEFAULT 1",
+				"ALTER TABLE {table} ADD COLUMN created bigint NOT NULL DEFAULT 0",
+				"CREATE TABLE IF NOT EXISTS `{table}_revisions` (" + `
+				id varchar(30) NOT NULL,
+				revision integer NOT NULL,
+				title varchar(50) default NULL,
+				hash char(40) default NULL,
+				data longtext,
+				lang varchar(50) default NULL,
+				style varchar(50) default NULL,
+				filename varchar(255) default NULL,
+				created bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id, revision))`,
+			},
+			"": {
+				"ALTER TABLE {table} ADD COLUMN revision integer NOT NULL DEFAULT 1",
+				"ALTER TABLE {table} ADD COLUMN created bigint NOT NULL DEFAULT 0",
+				`CREATE TABLE IF NOT EXISTS {table}_revisions (
+				id varchar(30) NOT NULL,
+				revision integer NOT NULL,
+				title varchar(50) default NULL,
+				hash char(40) default NULL,
+				data text,
+				lang varchar(50) default NULL,
+				style varchar(50) default NULL,
+				filename varchar(255) default NULL,
+				created bigint NOT NULL DEFAULT 0,
+				PRIMARY KEY (id, revision))`,
+			},
+		},
+	},
+	{
+		version:     13,
+		description: "add parent of forks",
+		up: map[string][]string{
+			"": {
+				"ALTER TABLE {table} ADD COLUMN parent varchar(30) default NULL",
+				"ALTER TABLE {table} ADD COLUMN parent_revision integer NOT NULL DEFAULT 0",
+				"CREATE INDEX {table}_parent_idx ON {table} (parent)",
+			},
+		},
+	},
+	{
+		version:     14,
+		description: "add files of bundles",
+		up: map[string][]string{
+			"mysql": {"CREATE TABLE IF NOT EXISTS `{table}_files` (" + `
+				id varchar(30) NOT NULL,
+				position integer NOT NULL,
+				filename varchar(255) NOT NULL,
+				lang varchar(50) default NULL,
+				hash char(40) default NULL,
+				data longtext,
+				PRIMARY KEY (id, position))`,
+			},
+			"": {`CREATE TABLE IF NOT EXISTS {table}_files (
+				id varchar(30) NOT NULL,
+				position integer NOT NULL,
+				filename varchar(255) NOT NULL,
+				lang varchar(50) default NULL,
+				hash char(40) default NULL,
+				data text,
+				PRIMARY KEY (id, position))`,
+			},
+		},
+	},
+	{
+		version:     15,
+		description: "add users and owners of pastes",
+		up: map[string][]string{
+			"": {
+				"ALTER TABLE {table} ADD COLUMN owner varchar(30) default NULL",
+				"CREATE INDEX {table}_owner_idx ON {table} (owner)",
+				`CREATE TABLE IF NOT EXISTS {table}_users (
+				name varchar(30) NOT NULL PRIMARY KEY,
+				password varchar(60) NOT NULL,
+				created bigint NOT NULL DEFAULT 0)`,
+				`CREATE TABLE IF NOT EXISTS {table}_sessions (
+				token char(64) NOT NULL PRIMARY KEY,
+				name varchar(30) NOT NULL,
+				expiry bigint NOT NULL)`,
+			},
+		},
+	},
+	{
+		version:     16,
+		description: "keep the created date of edited pastes",
+		up: map[string][]string{
+			"": {
+				"ALTER TABLE {table} ADD COLUMN edited bigint NOT NULL DEFAULT 0",
+				"UPDATE {table} SET edited = created WHERE revision > 1",
+				`UPDATE {table} SET created = (SELECT r.created FROM {table}_revisions r
+				WHERE r.id = {table}.id AND r.revision = 1) WHERE revision > 1`,
+			},
+		},
+	},
+}
+
+// statements returns the up statements of the migration for the given
+// dbtype with the table name filled in.
+func (m migration) statements(dbType string, table string) []string {
+	stmts, ok := m.up[dbType]
+	if !ok {
+		stmts = m.up[""]
+	}
+
+	var out []string
+	for _, s := range stmts {
+		out = append(out, strings.ReplaceAll(s, "{table}", table))
+	}
+	return out
+}
+
+// schemaVersion returns the latest applied migration, 0 if none is applied.
+func schemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (" +
+		"version integer NOT NULL PRIMARY KEY, applied bigint)")
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow("select max(version) from schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// migrate brings the database schema up to date by applying every migration
+// that is newer than the current schema version. Each migration is applied in
+// its own transaction together with the bump of schema_version, the version
+// is the primary key of schema_version so only one instance can record it.
+// An instance that loses the race to another one that starts at the same
+// time skips the migration. On MySQL the instances take turns instead, see
+// lockMigrations.
+func migrate(db *sql.DB, dbType string, table string) error {
+
+	if dbType == "mysql" {
+		unlock, err := lockMigrations(db, table)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	loggy(fmt.Sprintf("Database schema is at version %d (latest is %d)",
+		current, migrations[len(migrations)-1].version))
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		loggy(fmt.Sprintf("Applying migration %d (%s)", m.version,
+			m.description))
+
+		if err := applyMigration(db, dbType, table, m); err != nil {
+
+			// Another instance may have applied it in the meantime,
+			if v, verr := schemaVersion(db); verr == nil && v >= m.version {
+				loggy(fmt.Sprintf("Migration %d was applied by another instance.",
+					m.version))
+				continue
+			}
+			return fmt.Errorf("migration %d (%s) failed : %s", m.version,
+				m.description, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration applies the migration and records its version in one
+// transaction. The version is recorded first, so an instance that is
+// migrating at the same time fails on the primary key (or waits for the
+// first one to finish) before it changes anything. MySQL commits at every
+// schema change, so there the version is recorded last instead, and a
+// migration that fails leaves no trace of it. Since that doesn't keep two
+// instances from applying the same migration, migrate holds a lock on MySQL.
+func applyMigration(db *sql.DB, dbType string, table string, m migration) error {
+
+	record := func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO schema_version (version, applied) values(" +
+			strconv.Itoa(m.version) + "," +
+			strconv.FormatInt(time.Now().Unix(), 10) + ")")
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if dbType != "mysql" {
+		if err := record(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for _, stmt := range m.statements(dbType, table) {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if m.run != nil {
+		if err := m.run(tx, dbType, table); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if dbType == "mysql" {
+		if err := record(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockMigrations takes a named lock on MySQL, where every schema change is
+// committed right away, so the version can't be recorded before the
+// migration is applied. The lock belongs to a connection of its own and is
+// held until the returned function is called, an instance that starts at the
+// same time waits for it and then finds the migrations applied.
+func lockMigrations(db *sql.DB, table string) (func(), error) {
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "pastebin_migrate_" + table
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name,
+		migrationLockTimeout).Scan(&got)
+	if err == nil && got.Int64 != 1 {
+		err = fmt.Errorf("gave up waiting for another instance to migrate the database")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() {
+		conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+		conn.Close()
+	}, nil
+}
+
+// unescapePastes undoes the html escaping that used to be done before pastes
+// were stored. The hash is recalculated since it was made on the escaped data.
+func unescapePastes(tx *sql.Tx, dbType string, table string) error {
+
+	type row struct {
+		id, title, data string
+	}
+
+	// Read everything first, not all drivers likes queries while a result
+	// set is still open,
+	rows, err := tx.Query("select id, title, data from " + table)
+	if err != nil {
+		return err
+	}
+
+	var escaped []row
+	for rows.Next() {
+		var id string
+		var title, data sql.NullString
+		if err := rows.Scan(&id, &title, &data); err != nil {
+			rows.Close()
+			return err
+		}
+
+		r := row{id, html.UnescapeString(title.String),
+			html.UnescapeString(data.String)}
+		if r.title != title.String || r.data != data.String {
+			escaped = append(escaped, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range escaped {
+		_, err := tx.Exec("update "+table+" set title="+placeholder(dbType, 1)+
+			", data="+placeholder(dbType, 2)+", hash="+placeholder(dbType, 3)+
+			" where id="+placeholder(dbType, 4),
+			r.title, r.data, shaPaste(r.data), r.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	loggy(fmt.Sprintf("Unescaped %d pastes", len(escaped)))
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testDB opens an empty sqlite database in the temp dir of the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+
+		"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// eachStore runs the test against the memory store and against a sqlite
+// database, with store and users set to the one under test.
+func eachStore(t *testing.T, test func(t *testing.T)) {
+
+	t.Run("memory", func(t *testing.T) {
+		resetStore()
+		test(t)
+	})
+
+	t.Run("sqlite3", func(t *testing.T) {
+		resetStore()
+		db := testDB(t)
+		if err := migrate(db, "sqlite3", "pastebin"); err != nil {
+			t.Fatal(err)
+		}
+		s := newSQLStore(db, "sqlite3", "pastebin")
+		store, users = s, s
+		test(t)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	db := testDB(t)
+
+	if err := migrate(db, "sqlite3", "pastebin"); err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if v, err := schemaVersion(db); err != nil || v != latest {
+		t.Fatalf("schema version : got %d (%v), want %d", v, err, latest)
+	}
+
+	// Nothing left to do the second time,
+	if err := migrate(db, "sqlite3", "pastebin"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationIsOnlyAppliedOnce(t *testing.T) {
+	db := testDB(t)
+
+	if err := migrate(db, "sqlite3", "pastebin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An instance that didn't see that the version was recorded can't apply
+	// the migration again,
+	m := migrations[len(migrations)-1]
+	if err := applyMigration(db, "sqlite3", "pastebin", m); err == nil {
+		t.Fatalf("migration %d was applied twice", m.version)
+	}
+
+	var n int
+	err := db.QueryRow("select count(*) from schema_version where version = ?",
+		m.version).Scan(&n)
+	if err != nil || n != 1 {
+		t.Fatalf("version %d recorded %d times (%v)", m.version, n, err)
+	}
+}
+
+func TestConcurrentMigrate(t *testing.T) {
+	db := testDB(t)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = migrate(db, "sqlite3", "pastebin")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("instance %d : %s", i, err)
+		}
+	}
+
+	var n int
+	if err := db.QueryRow("select count(*) from schema_version").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Fatalf("%d versions recorded, want %d", n, len(migrations))
+	}
+}
+
+func TestMigrateKeepsCreatedOfEditedPastes(t *testing.T) {
+	db := testDB(t)
+
+	// A paste that was edited before the edited date was stored, the created
+	// date of the first revision is the one of the paste,
+	if _, err := schemaVersion(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version == 16 {
+			break
+		}
+		if err := applyMigration(db, "sqlite3", "pastebin", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stmt := range []string{
+		"insert into pastebin (id, data, revision, created) values ('edited', 'b', 2, 200)",
+		"insert into pastebin (id, data, revision, created) values ('plain', 'c', 1, 300)",
+		"insert into pastebin_revisions (id, revision, data, created) values ('edited', 1, 'a', 100)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrate(db, "sqlite3", "pastebin"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string][2]int64{"edited": {100, 200}, "plain": {300, 0}} {
+		var created, edited int64
+		err := db.QueryRow("select created, edited from pastebin where id = ?", id).Scan(
+			&created, &edited)
+		if err != nil || created != want[0] || edited != want[1] {
+			t.Fatalf("%s : got created %d and edited %d (%v), want %v", id, created,
+				edited, err, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Random string generation,
+	"github.com/dchest/uniuri"
+
+	// Password hashing,
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Wrong password attempts are limited to maxPasswordAttempts per paste within
+// passwordAttemptWindow.
+const maxPasswordAttempts = 5
+const passwordAttemptWindow = time.Minute
+
+// maxPasswordLength is the longest password bcrypt can hash, longer ones
+// are refused.
+const maxPasswordLength = 72
+
+// passwordHeader is the header that api clients can use for the password.
+const passwordHeader = "X-Paste-Password"
+
+// viewTokenLifetime is how long a page may render its paste again without
+// counting another view.
+const viewTokenLifetime = time.Hour
+
+// unlockSecret signs the cookies that are handed out when a paste has been
+// unlocked from the password form, a new one is generated at every start.
+var unlockSecret = []byte(uniuri.NewLen(32))
+
+// passwordAttempts keeps track of the failed password attempts per paste.
+var passwordAttempts = &attemptLimiter{attempts: make(map[string][]time.Time)}
+
+// pasteAuth is what a client gave to unlock a password protected paste.
+type pasteAuth struct {
+	password string // The clear text password from a form, header or json
+	token    string // The token from the cookie of a previous unlock
+	view     string // The view token of a page that already counted its view
+}
+
+// attemptLimiter counts failed attempts per key within a sliding window.
+type attemptLimiter struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+// prune drops attempts that are outside of the window, the lock must be held.
+func (l *attemptLimiter) prune(key string, now time.Time) {
+	var recent []time.Time
+	for _, t := range l.attempts[key] {
+		if now.Sub(t) < passwordAttemptWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) == 0 {
+		delete(l.attempts, key)
+		return
+	}
+	l.attempts[key] = recent
+}
+
+// allowed reports whether another attempt is allowed for the key.
+func (l *attemptLimiter) allowed(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(key, time.Now())
+	return len(l.attempts[key]) < maxPasswordAttempts
+}
+
+// failed registers a failed attempt for the key.
+func (l *attemptLimiter) failed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.attempts[key] = append(l.attempts[key], now)
+
+	// Don't let pastes that are never tried again pile up,
+	if len(l.attempts) > 1000 {
+		for k := range l.attempts {
+			l.prune(k, now)
+		}
+	}
+}
+
+// hashPassword returns the salted bcrypt hash of the password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// unlockToken returns the token that proves that the paste has been unlocked.
+// It's bound to the password hash as well, so a cookie of an earlier paste
+// with the same id, or from before the password changed, doesn't unlock it.
+func unlockToken(pasteId string, hash string) string {
+	mac := hmac.New(sha256.New, unlockSecret)
+	mac.Write([]byte(pasteId + "\x00" + hash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// viewToken returns the token that lets the page of a paste with a view
+// limit render it again (in another language or style) without counting
+// another view. It's valid until the given unix time.
+func viewToken(pasteId string, until int64) string {
+	mac := hmac.New(sha256.New, unlockSecret)
+	mac.Write([]byte("view\x00" + pasteId + "\x00" + strconv.FormatInt(until, 10)))
+	return strconv.FormatInt(until, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newViewToken returns a view token for the paste that is valid for
+// viewTokenLifetime.
+func newViewToken(pasteId string) string {
+	return viewToken(pasteId, time.Now().Add(viewTokenLifetime).Unix())
+}
+
+// validViewToken reports whether the token is a view token of the paste
+// that hasn't run out yet.
+func validViewToken(pasteId string, token string) bool {
+
+	untilS, _, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	until, err := strconv.ParseInt(untilS, 10, 64)
+	if err != nil || until <= time.Now().Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(viewToken(pasteId, until)))
+}
+
+// unlockCookieName returns the name of the cookie used for the paste.
+func unlockCookieName(pasteId string) string {
+	return "unlock_" + pasteId
+}
+
+// viewCookieName returns the name of the cookie with the view token of the
+// paste.
+func viewCookieName(pasteId string) string {
+	return "view_" + pasteId
+}
+
+// requestAuth collects the password (from the header or a posted form) and
+// the unlock cookie for the paste from the request. The view token is left
+// out, only the paste page and its re-renders may use it (see
+// requestViewToken).
+func requestAuth(r *http.Request, pasteId string) pasteAuth {
+
+	auth := pasteAuth{password: r.Header.Get(passwordHeader)}
+	if r.Method == "POST" && auth.password == "" {
+		auth.password = r.PostFormValue("password")
+	}
+
+	if c, err := r.Cookie(unlockCookieName(pasteId)); err == nil {
+		auth.token = c.Value
+	}
+
+	return auth
+}
+
+// requestViewToken returns the view token from the cookie of the paste, ""
+// if there is none.
+func requestViewToken(r *http.Request, pasteId string) string {
+	if c, err := r.Cookie(viewCookieName(pasteId)); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// setViewCookie hands out the view token of a page that counted its view.
+// It's kept in a cookie rather than on the page, so it stays with the browser
+// that used up the view and can't be passed on with the page.
+func setViewCookie(w http.ResponseWriter, pasteId string, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     viewCookieName(pasteId),
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(viewTokenLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// setUnlockCookie hands out a cookie with the unlock token so that the
+// browser doesn't have to give the password again for a while (for example
+// when changing style).
+func setUnlockCookie(w http.ResponseWriter, pasteId string, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(pasteId),
+		Value:    token,
+		Path:     "/",
+		MaxAge:   3600,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// checkPastePassword verifies the given auth against the password hash of the
+// paste. Returns "" if the paste may be shown, otherwise the status to return.
+func checkPastePassword(pasteId string, hash string, auth pasteAuth) string {
+
+	if hash == "" {
+		return ""
+	}
+
+	if auth.token != "" && hmac.Equal([]byte(auth.token),
+		[]byte(unlockToken(pasteId, hash))) {
+		loggy("Paste is unlocked by cookie.")
+		return ""
+	}
+
+	if auth.password == "" {
+		loggy("Paste is password protected and no password was given.")
+		return "Password required."
+	}
+
+	if !passwordAttempts.allowed(pasteId) {
+		loggy(fmt.Sprintf("Too many wrong passwords for paste '%s'.", pasteId))
+		return "Too many password attempts."
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(auth.password))
+	if err != nil {
+		loggy("Wrong password given for paste.")
+		passwordAttempts.failed(pasteId)
+		return "Wrong password."
+	}
+
+	loggy("Correct password given for paste.")
+	return ""
+}
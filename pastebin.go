@@ -3,7 +3,7 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
@@ -12,11 +12,13 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	// Random string generation,
@@ -32,79 +34,136 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// maxTitleLength is the longest title a paste may have.
+const maxTitleLength = 50
+
 // Configuration struct,
 type Configuration struct {
-	DBHost         string    `json:"dbhost"`     // Name of your database host
-	DBName         string    `json:"dbname"`     // Name of your database
-	DBPassword     string    `json:"dbpassword"` // The password for the database user
-	DBPlaceHolder  [6]string // ? / $[i] Depending on db driver.
-	DBPort         string    `json:"dbport"`                // Port of the database
-	DBTable        string    `json:"dbtable"`               // Name of the table in the database
-	DBType         string    `json:"dbtype"`                // Type of database
-	DBUser         string    `json:"dbuser"`                // The database user
-	DisplayName    string    `json:"displayname"`           // Name of your pastebin
-	Highlighter    string    `json:"highlighter"`           // The name of the highlighter.
-	ListenAddress  string    `json:"listenaddress"`         // Address that pastebin will bind on
-	ListenPort     string    `json:"listenport"`            // Port that pastebin will listen on
-	ShortUrlLength int       `json:"shorturllength,string"` // Length of the generated short urls
+	CacheDir         string `json:"cachedir"`                // Directory of the render cache, memory only if empty
+	CacheSize        int    `json:"cachesize,string"`        // Max number of cached renderings
+	DBHost           string `json:"dbhost"`                  // Name of your database host
+	DBName           string `json:"dbname"`                  // Name of your database
+	DBPassword       string `json:"dbpassword"`              // The password for the database user
+	DBPort           string `json:"dbport"`                  // Port of the database
+	DBTable          string `json:"dbtable"`                 // Name of the table in the database
+	DBType           string `json:"dbtype"`                  // Type of database
+	DBUser           string `json:"dbuser"`                  // The database user
+	AdminToken       string `json:"admintoken"`              // Token for the admin endpoints, disabled if empty
+	DisplayName      string `json:"displayname"`             // Name of your pastebin
+	HighlightEngine  string `json:"highlightengine"`         // Highlighting engine (chroma, pygments or plain)
+	HighlightTimeout int    `json:"highlighttimeout,string"` // Seconds a paste may take to highlight
+	HighlightWorkers int    `json:"highlightworkers,string"` // Max number of pastes highlighted at once
+	Highlighter      string `json:"highlighter"`             // Path to the highlighter-wrapper (optional for chroma)
+	ListenAddress    string `json:"listenaddress"`           // Address that pastebin will bind on
+	ListenPort       string `json:"listenport"`              // Port that pastebin will listen on
+	ReaperInterval   int    `json:"reaperinterval,string"`   // Seconds between removal of expired pastes
+	Registration     bool   `json:"registration,string"`     // If anyone may create an account
+	ShortUrlLength   int    `json:"shorturllength,string"`   // Length of the generated short urls
 }
 
 // This struct is used for responses.
 // A request to the pastebin will always this json struct.
 type Response struct {
-	DelKey string `json:"delkey"` // The id to use when delete a paste
-	Expiry string `json:"expiry"` // The date when post expires
-	Extra  string `json:"extra"`  // Extra output from the highlight-wrapper
-	Id     string `json:"id"`     // The id of the paste
-	Lang   string `json:"lang"`   // Specified language
-	Paste  string `json:"paste"`  // The eactual paste data
-	Sha1   string `json:"sha1"`   // The sha1 of the paste
-	Size   int    `json:"size"`   // The length of the paste
-	Status string `json:"status"` // A custom status message
-	Style  string `json:"style"`  // Specified style
-	Title  string `json:"title"`  // The title of the paste
-	Url    string `json:"url"`    // The url of the paste
+	Binary         bool           `json:"binary"`              // If the paste is binary (only available raw)
+	Burn           bool           `json:"burn"`                // If the paste is deleted after the first view
+	Code           int            `json:"-"`                   // The http code when the handler refused the paste
+	DelKey         string         `json:"delkey"`              // The id to use when delete a paste
+	Encrypted      bool           `json:"encrypted"`           // If the paste is encrypted by the client
+	Expiry         string         `json:"expiry"`              // The date when post expires
+	Extra          string         `json:"extra"`               // Extra output from the highlight-wrapper
+	Filename       string         `json:"filename"`            // The file name of the paste, if any
+	Files          []BundleFile   `json:"files,omitempty"`     // All the files if it's a bundle, the first is the paste
+	Id             string         `json:"id"`                  // The id of the paste
+	Lang           string         `json:"lang"`                // Specified language
+	Mime           string         `json:"mime"`                // The mime type of the paste
+	Paste          string         `json:"paste"`               // The eactual paste data
+	Forks          []string       `json:"forks,omitempty"`     // The ids of the forks of the paste (only api)
+	Outdated       bool           `json:"-"`                   // If it's an older revision (never cached)
+	Owner          string         `json:"-"`                   // The user that saved the paste, never shown
+	Parent         string         `json:"parent,omitempty"`    // The id of the paste this is a fork of
+	ParentRevision int            `json:"parentrevision"`      // The revision of the parent that was forked
+	Protected      bool           `json:"protected"`           // If the paste is password protected
+	RemainingViews int            `json:"remainingviews"`      // Views left, -1 means unlimited
+	Revision       int            `json:"revision"`            // The revision of the paste
+	Revisions      []RevisionInfo `json:"revisions,omitempty"` // All the revisions, oldest first (only api)
+	Sha1           string         `json:"sha1"`                // The sha1 of the paste
+	Size           int            `json:"size"`                // The length of the paste
+	Status         string         `json:"status"`              // A custom status message
+	Style          string         `json:"style"`               // Specified style
+	Title          string         `json:"title"`               // The title of the paste
+	Unlock         string         `json:"-"`                   // The unlock token of a protected paste, never shown
+	Url            string         `json:"url"`                 // The url of the paste
 }
 
 // This struct is used for indata when a request is being made to the pastebin.
 type Request struct {
-	DelKey string `json:"delkey"`        // The delkey that is used to delete paste
-	Expiry int64  `json:"expiry,string"` // An expiry date
-	Id     string `json:"id"`            // The id of the paste
-	Lang   string `json:"lang"`          // The language of the paste
-	Paste  string `json:"paste"`         // The actual pase
-	Style  string `json:"style"`         // The style of the paste
-	Title  string `json:"title"`         // The title of the paste
-	WebReq bool   `json:"webreq"`        // If its a webrequest or not
+	Binary    bool          `json:"-"`               // If the paste is binary (only uploads)
+	Burn      bool          `json:"burn"`            // Delete the paste after the first view
+	DelKey    string        `json:"delkey"`          // The delkey that is used to delete paste
+	Encrypted bool          `json:"encrypted"`       // If the paste is ciphertext (base64 of iv + data)
+	Expiry    int64         `json:"expiry,string"`   // An expiry date
+	Filename  string        `json:"filename"`        // The file name, used to pick the language
+	Files     []RequestFile `json:"files"`           // The files of a bundle, instead of paste
+	Hl        string        `json:"hl"`              // Lines to highlight, like 10-20 (only webreq)
+	Id        string        `json:"id"`              // The id of the paste
+	Lang      string        `json:"lang"`            // The language of the paste
+	MaxViews  int           `json:"maxviews,string"` // Delete the paste after this many views
+	Mime      string        `json:"-"`               // The detected mime type (only uploads)
+	Owner     string        `json:"-"`               // The logged in user, never taken from the client
+	Password  string        `json:"password"`        // The password needed to view the paste
+	Parent    string        `json:"parent"`          // The paste this is a fork of, id or id@revision
+	Paste     string        `json:"paste"`           // The actual pase
+	Render    string        `json:"render"`          // How to show the paste, "" or markdown (only webreq)
+	Style     string        `json:"style"`           // The style of the paste
+	Title     string        `json:"title"`           // The title of the paste
+	WebReq    bool          `json:"webreq"`          // If its a webrequest or not
 }
 
 // This struct is used for generating pages.
 type Page struct {
 	Body            template.HTML
+	DiffPath        string
+	EditId          string
+	EditPath        string
+	Encrypted       bool
 	Expiry          string
+	Files           []PageFile
+	Forks           []string
+	Gone            bool
+	Hl              string
 	Lang            string
 	LangsFirst      map[string]string
 	LangsLast       map[string]string
+	Parent          string
+	ParentDiffPath  string
+	ParentPath      string
 	PasteId         string
 	PasteTitle      string
+	RemainingViews  int
+	Render          string
+	RevPath         string
+	Revision        int
+	Revisions       []RevisionInfo
 	Style           string
 	SupportedStyles map[string]string
 	Title           string
+	User            string
 	WrapperErr      string
 }
 
 // Template pages,
 var templates = template.Must(template.ParseFiles("assets/index.html",
-	"assets/syntax.html"))
+	"assets/password.html", "assets/syntax.html", "assets/diff.html",
+	"assets/login.html", "assets/mine.html"))
 
 // Global variables, *shrug*
 var configuration Configuration
-var dbHandle *sql.DB
+var store PasteStore
+var users UserStore
+var highlighter Highlighter
+var pasteCache *renderCache
 var debug bool
 var debugLogger *log.Logger
-var listOfLangsFirst map[string]string
-var listOfLangsLast map[string]string
-var listOfStyles map[string]string
 var gets int
 
 //
@@ -127,90 +186,60 @@ func checkErr(err error) {
 	}
 }
 
-// getSupportedStyless reads supported styles from the highlighter-wrapper
-// (which in turn gets available styles from pygments). It then puts them into
-// an array which is used by the html-template. The function doesn't return
-// anything since the array is defined globally (shrug).
-func getSupportedStyles() {
-
-	listOfStyles = make(map[string]string)
+// getSupportedStyles reads supported styles from the highlighter engine. It
+// returns them in a map which is used by the html-template, the name is the
+// key and the display name is the value.
+func getSupportedStyles() (map[string]string, error) {
 
-	arg := "getstyles"
-	out, err := exec.Command(configuration.Highlighter, arg).Output()
+	list, err := highlighter.ListStyles()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Loop lexers and add them to respectively map,
-	for _, line := range strings.Split(string(out), "\n") {
-		if line == "" {
-			continue
-		}
-
-		loggy(fmt.Sprintf("Populating supported styles map with %s", line))
-		listOfStyles[line] = strings.Title(line)
+	styles := make(map[string]string)
+	for _, style := range list {
+		loggy(fmt.Sprintf("Populating supported styles map with %s", style))
+		styles[style] = strings.Title(style)
 	}
-}
 
-// getSupportedLangs reads supported lexers from the highlighter-wrapper (which
-// in turn gets available lexers from pygments). It then puts them into two
-// maps, depending on if it's a "prioritized" lexers. If it's prioritized or not
-// is determined by if its listed in the assets/prio-lexers.  The description is
-// the key and the actual lexer is the value. The maps are used by the
-// html-template. The function doesn't return anything since the maps are
-// defined globally (shrug).
-func getSupportedLangs() {
+	return styles, nil
+}
 
-	var prioLexers map[string]string
+// getSupportedLangs reads supported lexers from the highlighter engine. A
+// language is prioritized if it's listed in assets/prio-lexers, those are
+// shown first in the html-template.
+func getSupportedLangs() ([]Language, error) {
 
-	// Initialize maps,
-	prioLexers = make(map[string]string)
-	listOfLangsFirst = make(map[string]string)
-	listOfLangsLast = make(map[string]string)
+	prioLexers := make(map[string]string)
 
 	// Get prioritized lexers and put them in a separate map,
 	file, err := os.Open("assets/prio-lexers")
-	checkErr(err)
+	if err != nil {
+		return nil, err
+	}
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		prioLexers[scanner.Text()] = "1"
 	}
+	file.Close()
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	file.Close()
 
-	arg := "getlexers"
-	out, err := exec.Command(configuration.Highlighter, arg).Output()
+	langs, err := highlighter.ListLanguages()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Loop lexers and add them to respectively map,
-	for _, line := range strings.Split(string(out), "\n") {
-		if line == "" {
-			continue
-		}
-
-		s := strings.Split(line, ";")
-		if len(s) != 2 {
-			loggy(fmt.Sprintf("Could not split '%v' from %s (fields should be seperated by ;)",
-				s, configuration.Highlighter))
-			os.Exit(1)
-		}
-		s[0] = strings.Title(s[0])
-		if prioLexers[s[0]] == "1" {
-			loggy(fmt.Sprintf("Populating first languages map with %s - %s",
-				s[0], s[1]))
-			listOfLangsFirst[s[0]] = s[1]
-		} else {
-			loggy(fmt.Sprintf("Populating second languages map with %s - %s",
-				s[0], s[1]))
-			listOfLangsLast[s[0]] = s[1]
-		}
+	for i := range langs {
+		langs[i].Prioritized = prioLexers[langs[i].DisplayName] == "1"
+		loggy(fmt.Sprintf("Populating languages with %s - %s (prioritized %v)",
+			langs[i].DisplayName, langs[i].Alias, langs[i].Prioritized))
 	}
+
+	return langs, nil
 }
 
 // printHelp prints a description of the program.
@@ -219,7 +248,7 @@ func printHelp(err int) {
 
 	fmt.Printf("\n Description, \n")
 	fmt.Printf("    - This is a small (< 600 line of go) pastebing with")
-	fmt.Printf(" support for syntax highlightnig (trough python-pygments).\n")
+	fmt.Printf(" support for syntax highlightnig (trough chroma or python-pygments).\n")
 	fmt.Printf("      No more no less.\n\n")
 
 	fmt.Printf(" Usage, \n")
@@ -250,14 +279,11 @@ func checkArgs() {
 	}
 }
 
-// getDbHandle opens a connection to database.
+// getDbHandle opens a connection to database and runs the schema migrations.
 // Returns the dbhandle if the open was successful
 func getDBHandle() *sql.DB {
 
 	var dbinfo string
-	for i := 0; i < 6; i++ {
-		configuration.DBPlaceHolder[i] = "?"
-	}
 
 	switch configuration.DBType {
 
@@ -274,9 +300,6 @@ func getDBHandle() *sql.DB {
 			configuration.DBUser,
 			configuration.DBPassword,
 			configuration.DBName)
-		for i := 0; i < 6; i++ {
-			configuration.DBPlaceHolder[i] = "$" + strconv.Itoa(i+1)
-		}
 
 	case "mysql":
 		dbinfo = configuration.DBUser + ":" + configuration.DBPassword + "@tcp(" + configuration.DBHost + ":" + configuration.DBPort + ")/" + configuration.DBName
@@ -294,22 +317,34 @@ func getDBHandle() *sql.DB {
 	db, err := sql.Open(configuration.DBType, dbinfo)
 	checkErr(err)
 
-	// Just create a dummy query to really verify that the database is working as
-	// expected,
-	var dummy string
-	err = db.QueryRow("select id from " + configuration.DBTable + " where id='dummyid'").Scan(&dummy)
-
-	switch {
-	case err == sql.ErrNoRows:
-		loggy("Successfully connected and found table " + configuration.DBTable)
-	case err != nil:
+	// Bring the schema up to date, this also verifies that the database is
+	// working as expected,
+	err = migrate(db, configuration.DBType, configuration.DBTable)
+	if err != nil {
 		debugLogger.Println("   Database error : " + err.Error())
 		os.Exit(1)
 	}
+	loggy("Successfully connected and migrated table " + configuration.DBTable)
 
 	return db
 }
 
+// getStore returns the PasteStore and the UserStore for the configured
+// dbtype, both are kept in the same place. The "memory" type keeps everything
+// in memory and doesn't need a database at all.
+func getStore() (PasteStore, UserStore) {
+
+	if configuration.DBType == "memory" {
+		loggy("Specified databasetype : memory (pastes will not be persisted)")
+		m := newMemoryStore()
+		return m, m
+	}
+
+	s := newSQLStore(getDBHandle(), configuration.DBType,
+		configuration.DBTable)
+	return s, s
+}
+
 // generateName generates a short url with the length defined in main config
 // The function calls itself recursively until an id that doesn't exist is found
 // Returns the id
@@ -321,20 +356,17 @@ func generateName() string {
 		id))
 
 	// Query database if id exists and if it does call generateName again
-	var id_taken string
-	err := dbHandle.QueryRow("select id from "+configuration.DBTable+
-		" where id="+configuration.DBPlaceHolder[0], id).
-		Scan(&id_taken)
+	taken, err := store.Exists(id)
 
 	switch {
-	case err == sql.ErrNoRows:
-		loggy(fmt.Sprintf("Id '%s' is not taken, will use it.", id))
 	case err != nil:
 		debugLogger.Println("   Database error : " + err.Error())
 		os.Exit(1)
+	case taken:
+		loggy(fmt.Sprintf("Id '%s' is taken, generating new id.", id))
+		return generateName()
 	default:
-		loggy(fmt.Sprintf("Id '%s' is taken, generating new id.", id_taken))
-		generateName()
+		loggy(fmt.Sprintf("Id '%s' is not taken, will use it.", id))
 	}
 
 	return id
@@ -353,45 +385,103 @@ func shaPaste(paste string) string {
 	return sha
 }
 
+// pasteLang returns the language to remember for the paste, so that every
+// view highlights it the same way. It's autodetected if not given, encrypted
+// and binary pastes can't be detected though.
+func pasteLang(inData Request) string {
+
+	lang := inData.Lang
+	if lang == "autodetect" {
+		lang = ""
+	}
+	if lang == "" && inData.Filename != "" && !inData.Binary {
+		lang = langForFilename(inData.Filename)
+		loggy(fmt.Sprintf("Picked language '%s' from the filename '%s'.",
+			lang, inData.Filename))
+	}
+	if lang == "" && !inData.Encrypted && !inData.Binary {
+		_, _, lang, _ = high("", inData.Paste, "autodetect", inData.Style, nil)
+		if lang == "autodetect" {
+			lang = ""
+		}
+		loggy(fmt.Sprintf("Autodetected language '%s' for the paste.", lang))
+	}
+
+	return lang
+}
+
 // savePaste handles the saving for each paste.
 // Takes the arguments,
-// title, title of the paste as string,
-// paste, the actual paste data as a string,
-// expiry, the epxpiry date in epoch time as an int64
+// inData, the Request with the title, paste data, expiry offset in seconds,
+// burn flag, view limit and password of the paste,
+// hostname, the scheme and host used to build the url
 // Returns the Response struct
-func savePaste(title string, paste string, expiry int64, hostname string) Response {
+func savePaste(inData Request, hostname string) Response {
 
-	var id, hash, delkey, url string
+	var id, url string
 
-	// Escape user input,
-	paste = html.EscapeString(paste)
-	title = html.EscapeString(title)
+	// The data is stored exactly as given, escaping is done when rendering,
+	paste := inData.Paste
+	title := inData.Title
+	expiry := inData.Expiry
 
-	// Hash paste data and query database to see if paste exists
+	// Hash paste data and query database to see if paste exists, a bundle
+	// is identified by all of its files,
 	sha := shaPaste(paste)
+	bundle := len(inData.Files) > 0
+	if bundle {
+		sha = bundleHash(inData)
+	}
 	loggy("Checking if pasted data is already in the database.")
 
-	err := dbHandle.QueryRow("select id, title, hash, data, delkey from "+
-		configuration.DBTable+" where hash="+
-		configuration.DBPlaceHolder[0], sha).Scan(&id,
-		&title, &hash, &paste, &delkey)
+	// A fork keeps the link to where it came from,
+	parent, parentRev := forkParent(inData.Parent)
+
+	// A paste that is burned after reading, has a view limit or a password
+	// must never be shared with another paste, so don't even look for an
+	// existing one. Neither is a paste that has been edited, since it's
+	// likely to be edited again, and a fork is a new paste by intent. Bundles
+	// are always new as well, and so are pastes of logged in users so that
+	// they end up among their own. An expired paste that the reaper hasn't
+	// removed yet is as good as gone,
+	var existing Paste
+	err := ErrNotFound
+	if !inData.Burn && inData.MaxViews == 0 && inData.Password == "" &&
+		parent == "" && !bundle && inData.Owner == "" {
+		existing, err = store.FindByHash(sha)
+	}
+
 	switch {
-	case err == sql.ErrNoRows:
+	case err == ErrNotFound || existing.Burn || existing.MaxViews > 0 ||
+		existing.Password != "" || existing.Revision > 1 ||
+		!checkPasteExpiry(existing.Id, existing.Expiry):
 		loggy("Pasted data is not in the database, will insert it.")
 	case err != nil:
 		debugLogger.Println("   Database error : " + err.Error())
 		os.Exit(1)
 	default:
 		loggy(fmt.Sprintf("Pasted data already exists at id '%s' with title '%s'.",
-			id, html.UnescapeString(title)))
+			existing.Id, existing.Title))
 
 		return Response{
-			Status: "Paste data already exists ...",
-			Id:     id,
-			Title:  title,
-			Url:    url,
-			Sha1:   hash,
-			Size:   len(paste)}
+			Status:         "Paste data already exists ...",
+			Binary:         existing.Binary,
+			Mime:           existing.Mime,
+			Id:             existing.Id,
+			Title:          existing.Title,
+			Filename:       existing.Filename,
+			Lang:           existing.Lang,
+			Style:          existing.Style,
+			Url:            hostname + "/p/" + existing.Id,
+			Sha1:           existing.Hash,
+			Size:           len(existing.Data),
+			Revision:       existing.Revision,
+			RemainingViews: -1}
+	}
+
+	// Negative view limits makes no sense,
+	if inData.MaxViews < 0 {
+		inData.MaxViews = 0
 	}
 
 	// Generate id,
@@ -410,119 +500,309 @@ func savePaste(title string, paste string, expiry int64, hostname string) Respon
 
 	delKey := uniuri.NewLen(40)
 
-	// This is needed since mysql/postgres uses different placeholders,
-	var dbQuery string
-	for i := 0; i < 6; i++ {
-		dbQuery += configuration.DBPlaceHolder[i] + ","
-	}
-	dbQuery = dbQuery[:len(dbQuery)-1]
+	lang := pasteLang(inData)
 
-	stmt, err := dbHandle.Prepare("INSERT INTO " + configuration.DBTable + " (id,title,hash,data,delkey,expiry)values(" + dbQuery + ")")
-	checkErr(err)
+	// Only the salted hash of the password is stored,
+	var password string
+	if inData.Password != "" {
+		password, err = hashPassword(inData.Password)
+		checkErr(err)
+	}
 
-	_, err = stmt.Exec(id, title, sha, paste, delKey, expiry)
+	files := newFiles(inData)
+
+	saved := Paste{
+		Id:        id,
+		Title:     title,
+		Hash:      sha,
+		Data:      paste,
+		DelKey:    delKey,
+		Expiry:    expiry,
+		Burn:      inData.Burn,
+		MaxViews:  inData.MaxViews,
+		Encrypted: inData.Encrypted,
+		Password:  password,
+		Mime:      inData.Mime,
+		Binary:    inData.Binary,
+		Lang:      lang,
+		Style:     inData.Style,
+		Filename:  inData.Filename,
+		Revision:  1,
+		Created:   time.Now().Unix(),
+		Parent:    parent,
+		ParentRev: parentRev,
+		Files:     files,
+		Owner:     inData.Owner}
+	err = store.Save(saved)
 	checkErr(err)
 
-	loggy(fmt.Sprintf("Sucessfully inserted data at id '%s', title '%s', expiry '%v' and data \n \n* * * *\n\n%s\n\n* * * *\n",
+	logPaste := paste
+	if inData.Binary {
+		logPaste = fmt.Sprintf("<%d bytes of %s>", len(paste), inData.Mime)
+	}
+	loggy(fmt.Sprintf("Sucessfully inserted data at id '%s', title '%s', expiry '%v', burn '%v', max views '%v' and data \n \n* * * *\n\n%s\n\n* * * *\n",
 		id,
-		html.UnescapeString(title),
+		title,
 		expiry,
-		html.UnescapeString(paste)))
-	stmt.Close()
-	checkErr(err)
+		inData.Burn,
+		inData.MaxViews,
+		logPaste))
+
+	remaining := -1
+	if inData.MaxViews > 0 {
+		remaining = inData.MaxViews
+	}
+
+	// The files of a bundle are described, but not sent back,
+	var bundleList []BundleFile
+	if bundle {
+		bundleList = bundleFiles(saved, files)
+		setFileUrls(bundleList, id, hostname)
+		for i := range bundleList {
+			bundleList[i].Paste = ""
+		}
+	}
 
 	return Response{
-		Status: "Successfully saved paste.",
-		Id:     id,
-		Title:  title,
-		Sha1:   hash,
-		Url:    url,
-		Size:   len(paste),
-		DelKey: delKey}
+		Status:         "Successfully saved paste.",
+		Binary:         inData.Binary,
+		Mime:           inData.Mime,
+		Id:             id,
+		Title:          title,
+		Filename:       inData.Filename,
+		Files:          bundleList,
+		Lang:           lang,
+		Style:          inData.Style,
+		Sha1:           sha,
+		Url:            url,
+		Size:           len(paste),
+		DelKey:         delKey,
+		Burn:           inData.Burn,
+		Encrypted:      inData.Encrypted,
+		Protected:      password != "",
+		Revision:       1,
+		Parent:         parent,
+		ParentRevision: parentRev,
+		RemainingViews: remaining}
 }
 
 // DelHandler handles the deletion of pastes.
-// If pasteId and DelKey consist the paste will be removed.
+// If pasteId and DelKey consist the paste will be removed, the owner can
+// remove it without the DelKey when logged in.
 func DelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var inData Request
 
 	inData.Id = vars["pasteId"]
+	inData.DelKey = r.FormValue("delkey")
 
-	// Escape user input,
-	inData.DelKey = html.EscapeString(inData.DelKey)
-	inData.Id = html.EscapeString(inData.Id)
+	loggy(fmt.Sprintf("Trying to delete paste with id '%s' and delkey '%s'",
+		inData.Id, inData.DelKey))
 
-	fmt.Printf("Trying to delete paste with id '%s' and delkey '%s'\n",
-		inData.Id, inData.DelKey)
-	stmt, err := dbHandle.Prepare("delete from pastebin where delkey=" +
-		configuration.DBPlaceHolder[0] + " and id=" +
-		configuration.DBPlaceHolder[1])
-	checkErr(err)
-	res, err := stmt.Exec(inData.DelKey, inData.Id)
-	checkErr(err)
+	p, err := store.Get(inData.Id)
+	switch {
+	case err == ErrNotFound:
+		notfoundHandler(w, inData.Id)
+		return
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
 
-	_, err = res.RowsAffected()
+	if !mayChange(r, p, inData.DelKey) {
+		loggy("Given delkey doesn't match the one of the paste.")
+		http.Error(w, "Wrong delkey.", http.StatusForbidden)
+		return
+	}
 
-	if err != sql.ErrNoRows {
-		w.Header().Set("Content-Type", "application/json")
-		b := Response{Status: "Deleted paste " + inData.Id}
-		err := json.NewEncoder(w).Encode(b)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// The files of a bundle are gone with it,
+	files := pasteFiles(inData.Id)
+
+	err = store.Delete(inData.Id)
+	if err != nil && err != ErrNotFound {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+	invalidateRenders(p.Hash, files)
+
+	w.Header().Set("Content-Type", "application/json")
+	b := Response{Status: "Deleted paste " + inData.Id}
+	err = json.NewEncoder(w).Encode(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 }
 
-// SaveHandler will handle the actual save of each paste.
-// Returns with a Response struct.
-func SaveHandler(w http.ResponseWriter, r *http.Request) {
-	loggy(fmt.Sprintf("url=%s host=%s method=%s", r.URL.String(), r.Host, r.Method))
+// readRequest reads and checks the paste sent by the client, as json or as
+// an upload. The error is written to the client if something is wrong.
+func readRequest(w http.ResponseWriter, r *http.Request) (Request, bool) {
 
 	var inData Request
+	var err error
 
-	loggy(fmt.Sprintf("Recieving request to save new paste, trying to parse indata."))
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&inData)
+	// Json is what the web interface sends, everything else is an upload
+	// from curl and friends,
+	switch mediaType(r) {
+	case "application/json", "":
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&inData)
 
-	// Return error if we can't decode the json-data,
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		// Return error if we can't decode the json-data,
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return inData, false
+		}
+		inData.Mime = "text/plain; charset=utf-8"
+
+	default:
+		inData, err = formRequest(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return inData, false
+		}
 	}
 
-	d, _ := json.MarshalIndent(inData, "DEBUG : ", "  ")
+	// Never log the password or the delkey,
+	logData := inData
+	if logData.Password != "" {
+		logData.Password = "********"
+	}
+	if logData.DelKey != "" {
+		logData.DelKey = "********"
+	}
+	if logData.Binary {
+		logData.Paste = fmt.Sprintf("<%d bytes of %s>", len(logData.Paste),
+			logData.Mime)
+	}
+	d, _ := json.MarshalIndent(logData, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Successfully parsed json indata into struct \nDEBUG : %s", d))
 
+	// A bundle keeps its first file where a single paste keeps its data,
+	if len(inData.Files) > 0 {
+		if err := unpackBundle(&inData); err != nil {
+			loggy(fmt.Sprintf("Bad bundle received : %s", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return inData, false
+		}
+	}
+
 	// Return error if we don't have any data at all
 	if inData.Paste == "" {
 		loggy("Empty paste received, returning 500.")
 		http.Error(w, "Empty paste.", 500)
-		return
+		return inData, false
+	}
+
+	// The server never sees the key of an encrypted paste, but it can at
+	// least verify that the ciphertext is in the expected format,
+	if inData.Encrypted {
+		if _, err := base64.StdEncoding.DecodeString(inData.Paste); err != nil {
+			loggy("Encrypted paste is not base64 encoded, returning 400.")
+			http.Error(w, "Encrypted paste must be base64 encoded.",
+				http.StatusBadRequest)
+			return inData, false
+		}
+	}
+
+	// A burned paste is gone after the first view, so there's no point in a
+	// view limit as well,
+	if inData.Burn && inData.MaxViews > 0 {
+		loggy("Paste is both burn after reading and view limited, returning 400.")
+		http.Error(w, "A paste can't both be burned after reading and have a view limit.",
+			http.StatusBadRequest)
+		return inData, false
+	}
+
+	// Longer passwords can't be hashed,
+	if len(inData.Password) > maxPasswordLength {
+		loggy("Paste password to long, returning 400.")
+		http.Error(w, fmt.Sprintf("Password to long (max %d characters).",
+			maxPasswordLength), http.StatusBadRequest)
+		return inData, false
 	}
 
 	// Return error if title is to long
 	// TODO add check of paste size.
-	if len(inData.Title) > 50 {
+	if len(inData.Title) > maxTitleLength {
 		loggy(fmt.Sprintf("Paste title to long (%v).", len(inData.Title)))
-		http.Error(w, "Title to long.", 500)
-		return
+		http.Error(w, "Title to long.", http.StatusBadRequest)
+		return inData, false
+	}
+
+	// Only the name is of interest, never any directories,
+	inData.Filename = cleanFilename(inData.Filename)
+	if len(inData.Filename) > 255 {
+		loggy("Paste filename to long.")
+		http.Error(w, "Filename to long.", http.StatusBadRequest)
+		return inData, false
 	}
 
+	if len(inData.Lang) > 50 || len(inData.Style) > 50 {
+		loggy("Paste language or style to long.")
+		http.Error(w, "Language or style to long.", http.StatusBadRequest)
+		return inData, false
+	}
+
+	if len(inData.Parent) > 50 {
+		loggy("Paste parent to long.")
+		http.Error(w, "Parent to long.", http.StatusBadRequest)
+		return inData, false
+	}
+
+	return inData, true
+}
+
+// requestHost returns the scheme and host the request was made to, which is
+// what the urls of the pastes are built from.
+func requestHost(r *http.Request) string {
+
 	// Hmm, not sure why this why this is not in the request,
 	scheme := "http://"
 	if r.TLS != nil {
 		scheme = "https://"
 	}
+	return scheme + r.Host
+}
+
+// SaveHandler will handle the actual save of each paste.
+// Returns with a Response struct.
+func SaveHandler(w http.ResponseWriter, r *http.Request) {
+	loggy(fmt.Sprintf("url=%s host=%s method=%s", r.URL.String(), r.Host, r.Method))
+
+	loggy(fmt.Sprintf("Recieving request to save new paste, trying to parse indata."))
+
+	inData, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+	inData.Owner = sessionUser(r)
 
-	p := savePaste(inData.Title, inData.Paste, inData.Expiry, scheme+r.Host)
+	p := savePaste(inData, requestHost(r))
+	writeSaved(w, r, p)
+}
+
+// writeSaved answers a client that saved a paste, with the url of the paste
+// for those who asks for text and with the whole Response for everyone else.
+func writeSaved(w http.ResponseWriter, r *http.Request, p Response) {
+
+	// Just the url for those who asks for it, the delkey goes in a header
+	// so it isn't lost,
+	if wantsPlainText(r) {
+		loggy(fmt.Sprintf("Returning url %s to requester", p.Url))
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		if p.DelKey != "" {
+			w.Header().Set(headerPrefix+"Delkey", p.DelKey)
+		}
+		io.WriteString(w, p.Url+"\n")
+		return
+	}
 
-	d, _ = json.MarshalIndent(p, "DEBUG : ", "  ")
+	d, _ := json.MarshalIndent(p, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Returning json data to requester \nDEBUG : %s", d))
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(p)
+	err := json.NewEncoder(w).Encode(p)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -530,14 +810,17 @@ func SaveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// high calls the highlighter-wrapper and runs the paste through it.
+// high runs the paste through the configured highlighter engine, unless
+// it's already in the render cache.
 // Takes the arguments,
+// hash, the hash of the paste, "" if the result shouldn't be cached,
 // paste, the actual paste data as a string,
-// lang, the pygments lexer to use as a string,
-// style, the pygments style to use as a string
-// Returns two strings, first is the output from the pygments html-formatter,
-// the second is a custom message
-func high(paste string, lang string, style string) (string, string, string, string) {
+// lang, the lexer to use as a string,
+// style, the style to use as a string,
+// hl, the lines to highlight, nil for none
+// Returns four strings, first is the highlighted html, the second is a custom
+// message and the last two are the language and style that were used
+func high(hash string, paste string, lang string, style string, hl []lineRange) (string, string, string, string) {
 
 	// Defaults
 	var default_lang, default_style string
@@ -557,6 +840,7 @@ func high(paste string, lang string, style string) (string, string, string, stri
 		loggy(fmt.Sprintf("Language is not set, will set to '%s'", default_lang))
 	} else {
 		// Check for supported languages
+		listOfLangsFirst, listOfLangsLast, _ := supportedLists()
 		for _, v1 := range listOfLangsFirst {
 			if lang == v1 {
 				supported_lang = true
@@ -587,6 +871,7 @@ func high(paste string, lang string, style string) (string, string, string, stri
 		supported_style = true
 		loggy(fmt.Sprintf("Style is not set, will set to '%s'", default_style))
 	} else {
+		_, _, listOfStyles := supportedLists()
 		for _, s := range listOfStyles {
 			if style == strings.ToLower(s) {
 				supported_style = true
@@ -601,34 +886,40 @@ func high(paste string, lang string, style string) (string, string, string, stri
 			style, default_style))
 	}
 
-	if _, err := os.Stat(configuration.Highlighter); os.IsNotExist(err) {
-		log.Fatal(err)
+	if hash != "" {
+		if c, ok := pasteCache.get(hash, lang, style, hl); ok {
+			loggy("Returning the rendered paste from the cache.")
+			return c.Html, c.Extra, c.Lang, c.Style
+		}
 	}
 
-	loggy(fmt.Sprintf("Executing command : %s %s %s", configuration.Highlighter,
-		lang, style))
-	cmd := exec.Command(configuration.Highlighter, lang, style)
-	cmd.Stdin = strings.NewReader(paste)
-
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(configuration.HighlightTimeout)*time.Second)
+	defer cancel()
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
+	out, used, msg, err := renderLimited(ctx, paste, lang, style, hl)
+	if err == context.DeadlineExceeded {
+		loggy("The highlighter ran out of time, returning text.")
+		return "<pre>" + html.EscapeString(paste) + "</pre>",
+			"Highlighting took too long, returning plain text.", lang, style
+	}
 	if err != nil {
-		loggy(fmt.Sprintf("The highlightning feature failed, returning text. Error : %s", stderr.String()))
-		return paste, "Internal Error, returning plain text.", lang, style
+		loggy(fmt.Sprintf("The highlightning feature failed, returning text. Error : %s", err))
+		return "<pre>" + html.EscapeString(paste) + "</pre>",
+			"Internal Error, returning plain text.", lang, style
 	}
 
-	loggy(fmt.Sprintf("The wrapper returned the requested language (%s)", lang))
-	return stdout.String(), stderr.String(), lang, style
+	loggy(fmt.Sprintf("The highlighter used the language '%s'", used))
+	if hash != "" {
+		pasteCache.put(hash, lang, style, hl, rendered{out, msg, used, style})
+	}
+	return out, msg, used, style
 }
 
 // checkPasteExpiry checks if a paste is overdue.
 // It takes the pasteId as sting and the expiry date as an int64 as arguments.
-// If the paste is overdue it gets deleted and false is returned.
+// If the paste is overdue false is returned, the actual removal is left to
+// the reaper (see reaper.go).
 func checkPasteExpiry(pasteId string, expiry int64) bool {
 
 	loggy("Checking if paste is overdue.")
@@ -644,10 +935,10 @@ func checkPasteExpiry(pasteId string, expiry int64) bool {
 		loggy(fmt.Sprintf("Checking if paste is overdue (is %s later than %s).",
 			nowStr, expiryStr))
 
-		// If expiry is greater than current time, delete paste,
+		// If expiry is greater than current time, treat it as gone,
 		if now >= expiry {
-			loggy("User requested a paste that is overdue, deleting it.")
-			delPaste(pasteId)
+			loggy(fmt.Sprintf("User requested paste '%s' that is overdue.",
+				pasteId))
 			return false
 		}
 	}
@@ -655,37 +946,36 @@ func checkPasteExpiry(pasteId string, expiry int64) bool {
 	return true
 }
 
-// delPaste deletes the actual paste.
-// It takes the pasteId as sting as argument.
-func delPaste(pasteId string) {
-
-	// Prepare statement,
-	stmt, err := dbHandle.Prepare("delete from pastebin where id=" +
-		configuration.DBPlaceHolder[0])
-	checkErr(err)
-
-	// Execute it,
-	_, err = stmt.Exec(pasteId)
-	checkErr(err)
-
-	stmt.Close()
-	loggy("Successfully deleted paste.")
-}
+// pasteCheck lets a handler refuse a paste before it's burned or its view is
+// counted. It gets the requested revision and the other files of a bundle,
+// and returns the http code and the status if the paste can't be used, 0 if
+// it can.
+type pasteCheck func(p Paste, files []File) (int, string)
 
 // getPaste gets the paste from the database.
-// Takes the pasteid as a string argument.
+// Takes the pasteid as a string argument, the revision (0 for the latest),
+// the auth (password or unlock token) given by the client, which is needed
+// for password protected pastes, and the check of the handler (nil for none).
 // Returns the Response struct.
-func getPaste(pasteId string) Response {
+func getPaste(pasteId string, rev int, auth pasteAuth, check pasteCheck) Response {
+	return readPaste(pasteId, rev, auth, check, true)
+}
 
-	var title, paste string
-	var expiry int64
+// peekPaste is getPaste without burning the paste or counting a view, for
+// handlers that have to check more than one paste before using any of them.
+func peekPaste(pasteId string, rev int, auth pasteAuth, check pasteCheck) Response {
+	return readPaste(pasteId, rev, auth, check, false)
+}
 
-	err := dbHandle.QueryRow("select title, data, expiry from "+
-		configuration.DBTable+" where id="+configuration.DBPlaceHolder[0],
-		pasteId).Scan(&title, &paste, &expiry)
+// readPaste does the work of getPaste and peekPaste, the paste is only
+// burned and its view counted if consume is set.
+func readPaste(pasteId string, rev int, auth pasteAuth, check pasteCheck,
+	consume bool) Response {
+
+	p, err := store.Get(pasteId)
 
 	switch {
-	case err == sql.ErrNoRows:
+	case err == ErrNotFound:
 		loggy("Requested paste doesn't exist.")
 		return Response{Status: "Requested paste doesn't exist."}
 	case err != nil:
@@ -694,26 +984,156 @@ func getPaste(pasteId string) Response {
 	}
 
 	// Check if paste is overdue,
-	if !checkPasteExpiry(pasteId, expiry) {
+	if !checkPasteExpiry(pasteId, p.Expiry) {
 		return Response{Status: "Requested paste doesn't exist."}
 	}
 
-	// Unescape the saved data,
-	paste = html.UnescapeString(paste)
-	title = html.UnescapeString(title)
+	// Check the password before anything else, a wrong password must neither
+	// burn the paste nor count as a view,
+	if status := checkPastePassword(pasteId, p.Password, auth); status != "" {
+		return Response{Id: pasteId, Protected: true, Status: status}
+	}
+
+	// An older revision replaces the data, but everything else (like the
+	// expiry and the views) belongs to the paste,
+	var older *Paste
+	if rev != 0 && rev != p.Revision {
+		o, err := store.GetRevision(pasteId, rev)
+		switch {
+		case err == ErrNotFound:
+			loggy(fmt.Sprintf("Requested revision %d doesn't exist.", rev))
+			return Response{Status: "Requested paste doesn't exist."}
+		case err != nil:
+			debugLogger.Println("   Database error : " + err.Error())
+			os.Exit(1)
+		}
+		older = &o
+	}
+
+	// The other files of a bundle, read before a burn removes them,
+	files := pasteFiles(pasteId)
+
+	// A request the handler can't serve must neither burn the paste nor
+	// count as a view,
+	if check != nil {
+		requested := p
+		if older != nil {
+			requested.Title, requested.Data, requested.Hash = older.Title,
+				older.Data, older.Hash
+			requested.Filename, requested.Revision = older.Filename,
+				older.Revision
+		}
+		if code, status := check(requested, files); code != 0 {
+			loggy(fmt.Sprintf("Request for paste refused : %s", status))
+			return Response{Id: pasteId, Code: code, Status: status}
+		}
+	}
+
+	// Burn the paste if it should only be read once. The delete is what
+	// decides who gets to see it, only the reader that actually removed the
+	// paste returns it,
+	if p.Burn && consume {
+		err := store.Delete(pasteId)
+		switch {
+		case err == ErrNotFound:
+			loggy("Requested paste was already burned by another reader.")
+			return Response{Status: "Requested paste doesn't exist."}
+		case err != nil:
+			debugLogger.Println("   Database error : " + err.Error())
+			os.Exit(1)
+		}
+		loggy("Paste is burn after reading, deleted it.")
+	}
+
+	// Count the view if the paste has a view limit, this is also what
+	// enforces the limit when several readers shows up at the same time. A
+	// page that already counted its view may show the paste again with
+	// another language or style for free,
+	remaining := -1
+	if p.MaxViews > 0 && !consume {
+		remaining = p.MaxViews - p.Views
+	} else if p.MaxViews > 0 && validViewToken(pasteId, auth.view) {
+		loggy("Paste is shown again by a page that already counted its view.")
+		remaining = p.MaxViews - p.Views
+	} else if p.MaxViews > 0 {
+		p, err = store.View(pasteId)
+		switch {
+		case err == ErrNotFound:
+			loggy("Requested paste has no views left.")
+			return Response{Status: "Requested paste doesn't exist."}
+		case err != nil:
+			debugLogger.Println("   Database error : " + err.Error())
+			os.Exit(1)
+		}
+
+		remaining = p.MaxViews - p.Views
+		loggy(fmt.Sprintf("Paste has been viewed %d of %d times.", p.Views,
+			p.MaxViews))
+
+		// That was the last view, so the paste is gone now,
+		if remaining == 0 {
+			invalidateRenders(p.Hash, files)
+		}
+	}
+
+	paste := p.Data
+	title := p.Title
 
 	expiryS := "Never"
-	if expiry != 0 {
-		expiryS = time.Unix(expiry, 0).Format("2006-01-02 15:04:05")
+	switch {
+	case p.Burn:
+		expiryS = "Now (burned after reading)"
+	case p.Expiry != 0:
+		expiryS = time.Unix(p.Expiry, 0).Format("2006-01-02 15:04:05")
+	}
+
+	// Pastes from before mime types were stored are all text,
+	mimeType := p.Mime
+	if mimeType == "" {
+		mimeType = "text/plain; charset=utf-8"
 	}
 
 	r := Response{
-		Status: "Success",
-		Id:     pasteId,
-		Title:  title,
-		Paste:  paste,
-		Size:   len(paste),
-		Expiry: expiryS}
+		Binary:         p.Binary,
+		Mime:           mimeType,
+		Encrypted:      p.Encrypted,
+		Protected:      p.Password != "",
+		RemainingViews: remaining,
+		Burn:           p.Burn,
+		Status:         "Success",
+		Id:             pasteId,
+		Title:          title,
+		Paste:          paste,
+		Size:           len(paste),
+		Sha1:           p.Hash,
+		Filename:       p.Filename,
+		Lang:           p.Lang,
+		Style:          p.Style,
+		Revision:       p.Revision,
+		Parent:         p.Parent,
+		ParentRevision: p.ParentRev,
+		Owner:          p.Owner,
+		Expiry:         expiryS}
+
+	if p.Password != "" {
+		r.Unlock = unlockToken(pasteId, p.Password)
+	}
+
+	if len(files) > 0 {
+		r.Files = bundleFiles(p, files)
+	}
+
+	if older != nil {
+		r.Title = older.Title
+		r.Paste = older.Data
+		r.Size = len(older.Data)
+		r.Sha1 = older.Hash
+		r.Filename = older.Filename
+		r.Lang = older.Lang
+		r.Style = older.Style
+		r.Revision = older.Revision
+		r.Outdated = true
+	}
 
 	d, _ := json.MarshalIndent(r, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Returning data from getPaste \nDEBUG : %s", d))
@@ -730,7 +1150,8 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&inData)
 
-	if err != nil {
+	// A GET doesn't need a body at all,
+	if err != nil && err != io.EOF {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -739,13 +1160,50 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 		pasteId, inData.Lang, inData.Style))
 
 	// Get the actual paste data,
-	p := getPaste(pasteId)
-	if p.Status == "Requested paste doesn't exist." {
-		notfoundHandler(w, pasteId)
+	auth := requestAuth(r, pasteId)
+	if inData.Password != "" {
+		auth.password = inData.Password
+	}
+	// The page re-renders the paste in another language or style, that
+	// doesn't count as another view as long as it has the view cookie,
+	if inData.WebReq {
+		auth.view = requestViewToken(r, pasteId)
+	}
+
+	p := getPaste(pasteId, requestedRevision(r), auth, nil)
+	if !pasteAvailable(w, r, p, pasteId, false) {
 		return
 	}
+	p.Revisions = revisionList(pasteId, requestHost(r))
+	p.Forks = forkList(pasteId)
+	setFileUrls(p.Files, pasteId, requestHost(r))
+
+	// Ciphertext is never sent to the highlighter, the browser decrypts and
+	// highlights encrypted pastes itself,
+	switch {
+	case p.Binary:
+		// Binary data doesn't survive json, it's only available raw,
+		loggy("Paste is binary, will not return it in json.")
+		p.Paste = ""
+		p.Extra = "Binary paste, get it from /raw/" + pasteId + "."
+	case inData.WebReq && p.Encrypted:
+		loggy("Paste is encrypted, will not run it through the highlighter.")
+		p.Extra = "Encrypted paste, highlighting is done in the browser."
+	case inData.WebReq:
+		// Bad line ranges are ignored, the paste is still shown,
+		hl, err := parseLineRanges(inData.Hl)
+		if inData.Hl != "" && err != nil {
+			loggy(fmt.Sprintf("Ignoring the lines to highlight : %s", err))
+		}
+
+		// Use the language and style of the paste unless others are given,
+		if inData.Lang == "" {
+			inData.Lang = p.Lang
+		}
+		if inData.Style == "" {
+			inData.Style = p.Style
+		}
 
-	if inData.WebReq {
 		// If no style is given, use default style,
 		if inData.Style == "" {
 			inData.Style = "manni"
@@ -758,8 +1216,14 @@ func APIHandler(w http.ResponseWriter, r *http.Request) {
 			p.Url += "/" + inData.Lang
 		}
 
-		// Run it through the highgligther.,
-		p.Paste, p.Extra, p.Lang, p.Style = high(p.Paste, inData.Lang, inData.Style)
+		// Run it through the highgligther, or the markdown renderer,
+		if inData.Render == markdownMode {
+			p.Paste, p.Extra, p.Style = renderMarkdown(cacheHash(p), p.Paste,
+				inData.Style)
+		} else {
+			p.Paste, p.Extra, p.Lang, p.Style = high(cacheHash(p), p.Paste,
+				inData.Lang, inData.Style, hl)
+		}
 	}
 
 	d, _ := json.MarshalIndent(p, "DEBUG : ", "  ")
@@ -788,6 +1252,66 @@ func notfoundHandler(w http.ResponseWriter, pasteId string) {
 	w.Write(jsonResp)
 }
 
+// pasteAvailable checks the status returned by getPaste and writes the
+// proper response if the paste can't be shown. If form is true the password
+// form is shown for password protected pastes, otherwise a plain error.
+// Returns true if the paste is ok to use.
+func pasteAvailable(w http.ResponseWriter, r *http.Request, p Response,
+	pasteId string, form bool) bool {
+
+	// The check of the handler refused the paste,
+	if p.Code != 0 {
+		http.Error(w, p.Status, p.Code)
+		return false
+	}
+
+	switch p.Status {
+	case "Requested paste doesn't exist.":
+		notfoundHandler(w, pasteId)
+		return false
+	case "Password required.", "Wrong password.":
+		if form {
+			passwordHandler(w, pasteId, p.Status)
+		} else {
+			http.Error(w, p.Status, http.StatusUnauthorized)
+		}
+		return false
+	case "Too many password attempts.":
+		http.Error(w, p.Status, http.StatusTooManyRequests)
+		return false
+	}
+
+	// The right password was given in the form, let the browser skip the
+	// form for a while,
+	if form && p.Protected && r.Method == "POST" &&
+		r.PostFormValue("password") != "" {
+		setUnlockCookie(w, pasteId, p.Unlock)
+	}
+
+	return true
+}
+
+// wantsHTML reports whether the client is a browser that prefers html.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// passwordHandler shows the form asking for the password of a paste.
+func passwordHandler(w http.ResponseWriter, pasteId string, status string) {
+
+	page := &Page{
+		PasteId:    pasteId,
+		Title:      configuration.DisplayName,
+		WrapperErr: status,
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	err := templates.ExecuteTemplate(w, "password.html", page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // pasteHandler generates the html paste pages
 func pasteHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -798,54 +1322,204 @@ func pasteHandler(w http.ResponseWriter, r *http.Request) {
 
 	loggy(fmt.Sprintf("Getting paste with id '%s' and lang '%s' and style '%s'.", pasteId, lang, style))
 
+	// The lines to highlight, bad ranges are ignored,
+	hlQuery := r.URL.Query().Get("hl")
+	hl, err := parseLineRanges(hlQuery)
+	if hlQuery != "" && err != nil {
+		loggy(fmt.Sprintf("Ignoring the lines to highlight : %s", err))
+		hlQuery = ""
+	}
+
+	// Show the paste as markdown instead of highlighted source,
+	render := r.URL.Query().Get("render")
+	if render != "" && render != markdownMode {
+		loggy(fmt.Sprintf("Ignoring unknown render mode '%s'", render))
+		render = ""
+	}
+
 	// Get the actual paste data,
-	p := getPaste(pasteId)
-	if p.Status == "Requested paste doesn't exist." {
-		notfoundHandler(w, pasteId)
+	// The page may show a paste with a view limit again, in another
+	// language or style, without counting another view,
+	auth := requestAuth(r, pasteId)
+	auth.view = requestViewToken(r, pasteId)
+
+	p := getPaste(pasteId, requestedRevision(r), auth, nil)
+	if !pasteAvailable(w, r, p, pasteId, true) {
 		return
 	}
 
-	// Run it through the highgligther.,
-	p.Paste, p.Extra, p.Lang, p.Style = high(p.Paste, lang, style)
+	// The url overrides the language and style of the paste,
+	if lang == "" {
+		lang = p.Lang
+	}
+	if style == "" {
+		style = p.Style
+	}
+
+	// Run it through the highgligther, unless it's encrypted. In that case
+	// the page gets the escaped ciphertext, which is decrypted and highlighted
+	// in the browser with the key from the url fragment. Binary pastes are
+	// shown as images if possible, otherwise only described. Every file of a
+	// bundle keeps its own language,
+	var files []PageFile
+	if len(p.Files) > 0 {
+		loggy(fmt.Sprintf("Paste is a bundle of %d files.", len(p.Files)))
+		files, p.Style = renderBundle(p, style, render)
+		p.Paste = ""
+		p.Lang = "autodetect"
+		p.Extra = fmt.Sprintf("Bundle of %d files.", len(p.Files))
+	} else if p.Binary {
+		loggy("Paste is binary, will not run it through the highlighter.")
+		p.Paste = binaryBody(p)
+		p.Extra = fmt.Sprintf("Binary paste (%s, %d bytes).", p.Mime, p.Size)
+	} else if p.Encrypted {
+		loggy("Paste is encrypted, will not run it through the highlighter.")
+		p.Paste = html.EscapeString(p.Paste)
+		p.Lang = lang
+		if p.Lang == "" {
+			p.Lang = "autodetect"
+		}
+	} else if render == markdownMode {
+		p.Paste, p.Extra, p.Style = renderMarkdown(cacheHash(p), p.Paste, style)
+		p.Lang = lang
+		if p.Lang == "" {
+			p.Lang = "autodetect"
+		}
+	} else {
+		p.Paste, p.Extra, p.Lang, p.Style = high(cacheHash(p), p.Paste, lang, style, hl)
+	}
+
+	// Older revisions are linked with their number, the latest one without,
+	revPath := ""
+	if p.Outdated {
+		revPath = fmt.Sprintf("/rev/%d", p.Revision)
+	}
+
+	// Edited text pastes links to the changes since the previous revision,
+	diffPath := ""
+	if p.Revision > 1 && !p.Binary && !p.Encrypted {
+		diffPath = fmt.Sprintf("/diff/%s@%d/%s@%d", pasteId, p.Revision-1,
+			pasteId, p.Revision)
+	}
+
+	// Forks links back to the parent, as long as it's still around,
+	parentPath, parentDiffPath := "", ""
+	if p.Parent != "" {
+		exists, err := store.Exists(p.Parent)
+		checkErr(err)
+		if exists {
+			parentPath = fmt.Sprintf("/p/%s/rev/%d", p.Parent, p.ParentRevision)
+			if !p.Binary && !p.Encrypted && len(p.Files) == 0 {
+				parentDiffPath = fmt.Sprintf("/diff/%s@%d/%s@%d", p.Parent,
+					p.ParentRevision, pasteId, p.Revision)
+			}
+		}
+	}
+
+	// The view of a paste with a view limit was just counted, the browser
+	// gets a cookie to show it again with another language or style without
+	// counting another one. A burned paste, or one without views left, is
+	// gone already,
+	if p.RemainingViews > 0 && !validViewToken(pasteId, auth.view) {
+		setViewCookie(w, pasteId, newViewToken(pasteId))
+	}
+	gone := p.Burn || p.RemainingViews == 0
+
+	// The owner can edit the latest revision of text pastes in the browser,
+	editPath := ""
+	user := sessionUser(r)
+	if user != "" && user == p.Owner && !p.Outdated && !p.Binary &&
+		!p.Encrypted && len(p.Files) == 0 {
+		editPath = "/edit/" + pasteId
+	}
 
 	// Construct page struct
+	listOfLangsFirst, listOfLangsLast, listOfStyles := supportedLists()
 	page := &Page{
 		Body:            template.HTML(p.Paste),
+		DiffPath:        diffPath,
+		EditPath:        editPath,
+		Encrypted:       p.Encrypted,
 		Expiry:          p.Expiry,
+		Files:           files,
+		Forks:           forkList(pasteId),
+		Gone:            gone,
+		Hl:              hlQuery,
 		Lang:            p.Lang,
 		LangsFirst:      listOfLangsFirst,
 		LangsLast:       listOfLangsLast,
+		Parent:          p.Parent,
+		ParentDiffPath:  parentDiffPath,
+		ParentPath:      parentPath,
 		PasteId:         pasteId,
+		RemainingViews:  p.RemainingViews,
+		Render:          render,
+		RevPath:         revPath,
+		Revision:        p.Revision,
+		Revisions:       revisionList(pasteId, ""),
 		Style:           p.Style,
 		SupportedStyles: listOfStyles,
 		Title:           p.Title,
+		User:            user,
 		WrapperErr:      p.Extra,
 	}
 
-	err := templates.ExecuteTemplate(w, "syntax.html", page)
+	err = templates.ExecuteTemplate(w, "syntax.html", page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// binaryBody returns the html that shows a binary paste on the paste page.
+// Images are embedded, so showing one doesn't count as an extra view.
+func binaryBody(p Response) string {
+
+	mt, _, _ := mime.ParseMediaType(p.Mime)
+	if inlineTypes[mt] {
+		return "<img class=\"binary-paste\" alt=\"" + html.EscapeString(p.Title) +
+			"\" src=\"data:" + mt + ";base64," +
+			base64.StdEncoding.EncodeToString([]byte(p.Paste)) + "\">"
+	}
+
+	return "<pre class=\"binary-paste\">" +
+		html.EscapeString(fmt.Sprintf("%s, %d bytes, use download to get it.",
+			p.Mime, p.Size)) + "</pre>"
+}
+
 // CloneHandler handles generating the clone pages
 func CloneHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pasteId := vars["pasteId"]
 
-	p := getPaste(pasteId)
-	if p.Status == "Requested paste doesn't exist." {
-		notfoundHandler(w, pasteId)
+	// There's no way to edit binary data in the browser, and there's only
+	// room for one file,
+	check := func(p Paste, files []File) (int, string) {
+		switch {
+		case p.Binary:
+			return http.StatusBadRequest, "Binary pastes can't be cloned."
+		case len(files) > 0:
+			return http.StatusBadRequest, "Bundles can't be cloned."
+		}
+		return 0, ""
+	}
+
+	p := getPaste(pasteId, requestedRevision(r), requestAuth(r, pasteId), check)
+	if !pasteAvailable(w, r, p, pasteId, true) {
 		return
 	}
 
 	loggy(p.Paste)
 
-	// Clone page struct
+	// Clone page struct, an encrypted paste is decrypted by the browser. The
+	// clone is saved as a fork of the revision it was made from,
 	page := &Page{
 		Body:       template.HTML(p.Paste),
+		Encrypted:  p.Encrypted,
+		Parent:     fmt.Sprintf("%s@%d", pasteId, p.Revision),
+		ParentPath: fmt.Sprintf("/p/%s/rev/%d", pasteId, p.Revision),
 		PasteTitle: "Copy of " + p.Title,
 		Title:      "Copy of " + p.Title,
+		User:       sessionUser(r),
 	}
 
 	err := templates.ExecuteTemplate(w, "index.html", page)
@@ -859,15 +1533,26 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pasteId := vars["pasteId"]
 
-	p := getPaste(pasteId)
-	if p.Status == "Requested paste doesn't exist." {
-		notfoundHandler(w, pasteId)
+	p := getPaste(pasteId, requestedRevision(r), requestAuth(r, pasteId), nil)
+	if !pasteAvailable(w, r, p, pasteId, wantsHTML(r)) {
+		return
+	}
+
+	if p.Binary {
+		writeBinaryPaste(w, p, true)
+		return
+	}
+
+	// All the files of a bundle in one go,
+	if len(p.Files) > 0 {
+		writeBundleZip(w, p)
 		return
 	}
 
 	// Set header to an attachment so browser will automatically download it
-	w.Header().Set("Content-Disposition", "attachment; filename="+p.Title)
-	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": downloadName(p)}))
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 	io.WriteString(w, p.Paste)
 }
 
@@ -876,12 +1561,52 @@ func RawHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	pasteId := vars["pasteId"]
 
-	p := getPaste(pasteId)
-	if p.Status == "Requested paste doesn't exist." {
-		notfoundHandler(w, pasteId)
+	// Only some of the lines, parsed before the paste is fetched so that a
+	// bad request doesn't use up a view,
+	var ranges []lineRange
+	if lines := r.URL.Query().Get("lines"); lines != "" {
+		var err error
+		ranges, err = parseLineRanges(lines)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The file must be in the bundle, and lines can only be selected from
+	// text,
+	filename, oneFile := vars["filename"]
+	check := func(p Paste, files []File) (int, string) {
+		switch {
+		case oneFile && !hasFile(p, files, filename):
+			return http.StatusNotFound, "File not found in the paste."
+		case ranges != nil && (p.Binary || p.Encrypted):
+			return http.StatusBadRequest, "Lines can only be selected from text pastes."
+		}
+		return 0, ""
+	}
+
+	p := getPaste(pasteId, requestedRevision(r), requestAuth(r, pasteId), check)
+	if !pasteAvailable(w, r, p, pasteId, wantsHTML(r)) {
 		return
 	}
 
+	// One of the files of a bundle,
+	if oneFile {
+		f, _ := findFile(p.Files, filename)
+		p.Paste = f.Paste
+	}
+
+	// The original bytes with the detected type,
+	if p.Binary {
+		writeBinaryPaste(w, p, false)
+		return
+	}
+
+	if ranges != nil {
+		p.Paste = selectLines(p.Paste, ranges)
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8; imeanit=yes")
 
 	// Simply write string to browser
@@ -891,14 +1616,16 @@ func RawHandler(w http.ResponseWriter, r *http.Request) {
 // RootHandler handles generating the root page
 func RootHandler(w http.ResponseWriter, r *http.Request) {
 
+	listOfLangsFirst, listOfLangsLast, _ := supportedLists()
 	p := &Page{
 		LangsFirst: listOfLangsFirst,
 		LangsLast:  listOfLangsLast,
 		Title:      configuration.DisplayName,
+		User:       sessionUser(r),
 	}
 
 	gets++
-	
+
 	err := templates.ExecuteTemplate(w, "index.html", p)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -911,15 +1638,124 @@ func MetricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8; imeanit=yes")
 
 	str := "http_requests_total{method=\"any\"} "
-	str += strconv.Itoa(gets)
+	str += strconv.Itoa(gets) + "\n"
+	str += "pastebin_expired_pastes_removed_total "
+	str += strconv.FormatInt(atomic.LoadInt64(&reapedPastes), 10) + "\n"
+	str += "pastebin_render_cache_hits_total "
+	str += strconv.FormatInt(atomic.LoadInt64(&renderCacheHits), 10) + "\n"
+	str += "pastebin_render_cache_misses_total "
+	str += strconv.FormatInt(atomic.LoadInt64(&renderCacheMisses), 10) + "\n"
 
 	io.WriteString(w, str)
 }
 
+// LanguagesHandler lists the supported languages as json, the prioritized
+// ones first.
+func LanguagesHandler(w http.ResponseWriter, r *http.Request) {
+
+	langs := append([]Language{}, supportedLanguages()...)
+	for i := range langs {
+		if langs[i].Extensions == nil {
+			langs[i].Extensions = []string{}
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		if langs[i].Prioritized != langs[j].Prioritized {
+			return langs[i].Prioritized
+		}
+		return strings.ToLower(langs[i].DisplayName) <
+			strings.ToLower(langs[j].DisplayName)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(langs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// StylesHandler lists the supported styles as json.
+func StylesHandler(w http.ResponseWriter, r *http.Request) {
+
+	type style struct {
+		DisplayName string `json:"displayname"`
+		Name        string `json:"name"`
+	}
+
+	_, _, listOfStyles := supportedLists()
+	styles := []style{}
+	for name, display := range listOfStyles {
+		styles = append(styles, style{display, name})
+	}
+	sort.Slice(styles, func(i, j int) bool {
+		return styles[i].Name < styles[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(styles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func serveCss(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "assets/pastebin.css")
 }
 
+func serveCryptoJs(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "assets/crypto.js")
+}
+
+// newRouter returns the router with all the routes of the pastebin.
+func newRouter() *mux.Router {
+
+	router := mux.NewRouter()
+
+	// Routes,
+	router.HandleFunc("/", RootHandler)
+	router.HandleFunc("/p/{pasteId}", pasteHandler).Methods("GET", "POST")
+	router.HandleFunc("/p/{pasteId}/rev/{rev:[0-9]+}", pasteHandler).Methods("GET", "POST")
+	router.HandleFunc("/p/{pasteId}/{lang}", pasteHandler).Methods("GET", "POST")
+	router.HandleFunc("/p/{pasteId}/{lang}/{style}", pasteHandler).Methods("GET", "POST")
+
+	// Api
+	router.HandleFunc("/api", SaveHandler).Methods("POST")
+	router.HandleFunc("/api/languages", LanguagesHandler).Methods("GET")
+	router.HandleFunc("/api/diff/{pasteA}/{pasteB}", DiffAPIHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/styles", StylesHandler).Methods("GET")
+	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("POST")
+	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("GET")
+	router.HandleFunc("/api/{pasteId}", DelHandler).Methods("DELETE")
+	router.HandleFunc("/api/{pasteId}", EditHandler).Methods("PUT")
+	router.HandleFunc("/api/{pasteId}/rev/{rev:[0-9]+}", APIHandler).Methods("GET", "POST")
+
+	router.HandleFunc("/raw/{pasteId}", RawHandler).Methods("GET", "POST")
+	router.HandleFunc("/raw/{pasteId}/rev/{rev:[0-9]+}", RawHandler).Methods("GET", "POST")
+	router.HandleFunc("/raw/{pasteId}/{filename}", RawHandler).Methods("GET", "POST")
+	router.HandleFunc("/clone/{pasteId}", CloneHandler).Methods("GET", "POST")
+	router.HandleFunc("/clone/{pasteId}/rev/{rev:[0-9]+}", CloneHandler).Methods("GET", "POST")
+
+	router.HandleFunc("/download/{pasteId}", DownloadHandler).Methods("GET", "POST")
+	router.HandleFunc("/edit/{pasteId}", EditPageHandler).Methods("GET")
+	router.HandleFunc("/login", LoginHandler).Methods("GET", "POST")
+	router.HandleFunc("/logout", LogoutHandler).Methods("POST")
+	router.HandleFunc("/mine", MineHandler).Methods("GET")
+	router.HandleFunc("/register", RegisterHandler).Methods("POST")
+	router.HandleFunc("/diff/{pasteA}/{pasteB}", DiffHandler).Methods("GET", "POST")
+	router.HandleFunc("/diff/{pasteA}/{pasteB}/raw", DiffRawHandler).Methods("GET", "POST")
+	router.HandleFunc("/download/{pasteId}/rev/{rev:[0-9]+}", DownloadHandler).Methods("GET", "POST")
+	router.HandleFunc("/assets/pastebin.css", serveCss).Methods("GET")
+	router.HandleFunc("/assets/crypto.js", serveCryptoJs).Methods("GET")
+
+	// Metrics
+	router.HandleFunc("/metrics", MetricsHandler)
+
+	// Admin
+	router.HandleFunc("/admin/reload", ReloadHandler).Methods("POST")
+
+	return router
+}
+
 func main() {
 
 	// Set up new logger,
@@ -947,37 +1783,39 @@ func main() {
 	d, _ := json.MarshalIndent(configuration, "DEBUG : ", "  ")
 	loggy(fmt.Sprintf("Successfully parsed json data into struct \nDEBUG : %s", d))
 
-	// Get languages and styles,
-	getSupportedLangs()
-	getSupportedStyles()
-
-	// Get the database handle
-	dbHandle = getDBHandle()
+	// Get the highlighter engine and its languages and styles,
+	highlighter, err = newHighlighter(configuration.HighlightEngine,
+		configuration.Highlighter)
+	if err != nil {
+		loggy(fmt.Sprintf("Error setting up the highlighter : %s", err))
+		os.Exit(1)
+	}
+	setHighlightLimits(&configuration)
+	if err := reloadLists(); err != nil {
+		loggy(fmt.Sprintf("Error getting languages and styles : %s", err))
+		os.Exit(1)
+	}
 
-	// Router object,
-	router := mux.NewRouter()
+	// Get new languages and styles on SIGHUP,
+	reloadOnSighup()
 
-	// Routes,
-	router.HandleFunc("/", RootHandler)
-	router.HandleFunc("/p/{pasteId}", pasteHandler).Methods("GET")
-	router.HandleFunc("/p/{pasteId}/{lang}", pasteHandler).Methods("GET")
-	router.HandleFunc("/p/{pasteId}/{lang}/{style}", pasteHandler).Methods("GET")
+	// Set up the cache of rendered pastes,
+	pasteCache, err = newRenderCache(configuration.CacheSize,
+		configuration.CacheDir)
+	if err != nil {
+		loggy(fmt.Sprintf("Error setting up the render cache : %s", err))
+		os.Exit(1)
+	}
 
-	// Api
-	router.HandleFunc("/api", SaveHandler).Methods("POST")
-	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("POST")
-	router.HandleFunc("/api/{pasteId}", APIHandler).Methods("GET")
-	router.HandleFunc("/api/{pasteId}", DelHandler).Methods("DELETE")
+	// Get the paste and user stores (and the database handle if needed),
+	store, users = getStore()
 
-	router.HandleFunc("/raw/{pasteId}", RawHandler).Methods("GET")
-	router.HandleFunc("/clone/{pasteId}", CloneHandler).Methods("GET")
+	// Remove expired pastes in the background,
+	startReaper(configuration.ReaperInterval)
 
-	router.HandleFunc("/download/{pasteId}", DownloadHandler).Methods("GET")
-	router.HandleFunc("/assets/pastebin.css", serveCss).Methods("GET")
+	// Router object,
+	router := newRouter()
 
-	// Metrics
-	router.HandleFunc("/metrics", MetricsHandler)
-	
 	// Set up server,
 	srv := &http.Server{
 		Handler:      router,
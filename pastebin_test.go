@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain sets up what main would, with everything kept in memory.
+func TestMain(m *testing.M) {
+
+	debugLogger = log.New(io.Discard, "DEBUG : ", 0)
+
+	configuration = Configuration{
+		DisplayName:     "Test",
+		HighlightEngine: "chroma",
+		ShortUrlLength:  8,
+	}
+
+	var err error
+	highlighter, err = newHighlighter(configuration.HighlightEngine, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	setHighlightLimits(&configuration)
+	if err := reloadLists(); err != nil {
+		log.Fatal(err)
+	}
+
+	pasteCache, err = newRenderCache(100, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// resetStore gives the test empty stores of its own.
+func resetStore() {
+	m := newMemoryStore()
+	store, users = m, m
+	passwordAttempts = &attemptLimiter{attempts: make(map[string][]time.Time)}
+}
+
+// do sends a request through the router and returns the recorded response.
+func do(method string, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// save saves the paste described by the json fields and returns the
+// response, the test fails unless it's saved.
+func save(t *testing.T, fields map[string]interface{}) Response {
+	t.Helper()
+
+	d, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := do("POST", "/api", string(d),
+		map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("saving paste : got %d (%s)", w.Code, w.Body.String())
+	}
+
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// raw returns the code and the body of the raw paste.
+func raw(id string, header map[string]string) (int, string) {
+	w := do("GET", "/raw/"+id, "", header)
+	return w.Code, w.Body.String()
+}
+
+func TestSaveAndGet(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"title": "Hello", "paste": "hello world\n"})
+	if saved.Id == "" || saved.DelKey == "" || saved.RemainingViews != -1 {
+		t.Fatalf("unexpected response %+v", saved)
+	}
+
+	if code, body := raw(saved.Id, nil); code != http.StatusOK || body != "hello world\n" {
+		t.Fatalf("raw : got %d %q", code, body)
+	}
+
+	w := do("GET", "/api/"+saved.Id, "", nil)
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Hello" || p.Paste != "hello world\n" || p.Sha1 != saved.Sha1 {
+		t.Fatalf("api : got %+v", p)
+	}
+
+	if w := do("GET", "/p/"+saved.Id, "", nil); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "hello world") {
+		t.Fatalf("page : got %d", w.Code)
+	}
+
+	// The same data ends up at the same paste,
+	again := save(t, map[string]interface{}{"paste": "hello world\n"})
+	if again.Id != saved.Id {
+		t.Fatalf("expected the existing paste %s, got %s", saved.Id, again.Id)
+	}
+
+	if code, _ := raw("missing", nil); code != http.StatusNotFound {
+		t.Fatalf("missing paste : got %d", code)
+	}
+}
+
+func TestEmptyPaste(t *testing.T) {
+	resetStore()
+
+	w := do("POST", "/api", `{"paste": ""}`,
+		map[string]string{"Content-Type": "application/json"})
+	if w.Code == http.StatusOK {
+		t.Fatalf("empty paste was saved")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "to be deleted"})
+
+	if w := do("DELETE", "/api/"+saved.Id+"?delkey=wrong", "", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong delkey : got %d", w.Code)
+	}
+	if w := do("DELETE", "/api/"+saved.Id+"?delkey="+saved.DelKey, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete : got %d", w.Code)
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("deleted paste : got %d", code)
+	}
+}
+
+func TestBurn(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "secret", "burn": true})
+
+	if code, body := raw(saved.Id, nil); code != http.StatusOK || body != "secret" {
+		t.Fatalf("first read : got %d %q", code, body)
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("second read : got %d", code)
+	}
+
+	// A burned paste is never shared with a later paste of the same data,
+	first := save(t, map[string]interface{}{"paste": "again", "burn": true})
+	second := save(t, map[string]interface{}{"paste": "again"})
+	if first.Id == second.Id {
+		t.Fatalf("burned paste was reused")
+	}
+}
+
+func TestMaxViews(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "counted", "maxviews": "2"})
+	if saved.RemainingViews != 2 {
+		t.Fatalf("remaining views : got %d", saved.RemainingViews)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code, _ := raw(saved.Id, nil); code != http.StatusOK {
+			t.Fatalf("view %d : got %d", i+1, code)
+		}
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("view 3 : got %d", code)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	resetStore()
+
+	now := time.Now().Unix()
+	for _, p := range []Paste{
+		{Id: "expired", Hash: "a", Data: "old", Expiry: now - 10, Revision: 1},
+		{Id: "current", Hash: "b", Data: "new", Expiry: now + 3600, Revision: 1},
+	} {
+		if err := store.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code, _ := raw("expired", nil); code != http.StatusNotFound {
+		t.Fatalf("expired paste : got %d", code)
+	}
+	if code, body := raw("current", nil); code != http.StatusOK || body != "new" {
+		t.Fatalf("current paste : got %d %q", code, body)
+	}
+
+	// An expired paste that is still around isn't handed out for the same
+	// data,
+	if err := store.Save(Paste{Id: "stale", Hash: shaPaste("stale"), Data: "stale",
+		Expiry: now - 10, Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if again := save(t, map[string]interface{}{"paste": "stale"}); again.Id == "stale" {
+		t.Fatalf("expired paste was reused")
+	}
+
+	// The expiry is given in seconds from now,
+	saved := save(t, map[string]interface{}{"paste": "soon gone", "expiry": "3600"})
+	p, err := store.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Expiry < now+3600 || p.Expiry > now+3700 {
+		t.Fatalf("expiry : got %d", p.Expiry)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "protected", "password": "hunter2",
+		"burn": true})
+	if !saved.Protected {
+		t.Fatalf("paste isn't protected")
+	}
+
+	// The password is never stored in clear text,
+	p, err := store.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Password == "" || p.Password == "hunter2" {
+		t.Fatalf("password stored as %q", p.Password)
+	}
+
+	if code, _ := raw(saved.Id, nil); code != http.StatusUnauthorized {
+		t.Fatalf("no password : got %d", code)
+	}
+
+	// A wrong password doesn't burn the paste,
+	if code, _ := raw(saved.Id, map[string]string{passwordHeader: "wrong"}); code != http.StatusUnauthorized {
+		t.Fatalf("wrong password : got %d", code)
+	}
+	code, body := raw(saved.Id, map[string]string{passwordHeader: "hunter2"})
+	if code != http.StatusOK || body != "protected" {
+		t.Fatalf("right password : got %d %q", code, body)
+	}
+}
+
+func TestPasswordAttempts(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "protected", "password": "hunter2"})
+
+	for i := 0; i < maxPasswordAttempts; i++ {
+		raw(saved.Id, map[string]string{passwordHeader: "wrong"})
+	}
+	if code, _ := raw(saved.Id, map[string]string{passwordHeader: "hunter2"}); code != http.StatusTooManyRequests {
+		t.Fatalf("after too many attempts : got %d", code)
+	}
+}
+
+func TestBurnWithMaxViews(t *testing.T) {
+	resetStore()
+
+	w := do("POST", "/api", `{"paste": "both", "burn": true, "maxviews": "3"}`,
+		map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("burn and view limit : got %d", w.Code)
+	}
+}
+
+// viewCookie returns the view cookie the response sets for the paste, ""
+// if there is none.
+func viewCookie(w *httptest.ResponseRecorder, pasteId string) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == viewCookieName(pasteId) {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestRerenderDoesNotCountView(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "counted", "maxviews": "3"})
+
+	w := do("GET", "/p/"+saved.Id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("page : got %d", w.Code)
+	}
+	token := viewCookie(w, saved.Id)
+	if token == "" {
+		t.Fatalf("no view cookie")
+	}
+	if strings.Contains(w.Body.String(), token) {
+		t.Fatalf("view token on the page")
+	}
+	cookie := map[string]string{"Cookie": viewCookieName(saved.Id) + "=" + token,
+		"Content-Type": "application/json"}
+
+	// Changing the style on the page shows the paste again for free, and so
+	// does loading the page again,
+	for i := 0; i < 3; i++ {
+		w = do("POST", "/api/"+saved.Id, `{"style": "monokai", "webreq": true}`, cookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("rerender : got %d", w.Code)
+		}
+	}
+	w = do("GET", "/p/"+saved.Id+"/go/monokai", "", cookie)
+	if w.Code != http.StatusOK || viewCookie(w, saved.Id) != "" {
+		t.Fatalf("page again : got %d", w.Code)
+	}
+	if p, err := store.Get(saved.Id); err != nil || p.Views != 1 {
+		t.Fatalf("views after rerender : got %d (%v)", p.Views, err)
+	}
+
+	// Anywhere else the token counts as usual, as does a made up or
+	// foreign one,
+	if code, _ := raw(saved.Id, cookie); code != http.StatusOK {
+		t.Fatalf("raw with the view cookie : got %d", code)
+	}
+	w = do("POST", "/raw/"+saved.Id, "viewtoken="+token,
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("raw with a posted view token : got %d", w.Code)
+	}
+	if code, _ := raw(saved.Id, nil); code != http.StatusNotFound {
+		t.Fatalf("no views left : got %d", code)
+	}
+
+	other := save(t, map[string]interface{}{"paste": "other", "maxviews": "2"})
+	for _, bad := range []string{"", "1.x", viewToken(saved.Id, 1),
+		newViewToken(other.Id)} {
+		if validViewToken(saved.Id, bad) {
+			t.Fatalf("token %q accepted", bad)
+		}
+	}
+}
+
+func TestPageOfLastView(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "once", "maxviews": "1"})
+
+	w := do("GET", "/p/"+saved.Id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("page : got %d", w.Code)
+	}
+	if viewCookie(w, saved.Id) != "" {
+		t.Fatalf("view cookie for a paste that is gone")
+	}
+	if !regexp.MustCompile(`const gone = \s*true`).MatchString(w.Body.String()) {
+		t.Fatalf("paste isn't marked as gone")
+	}
+}
+
+func TestRefusedRequestsKeepThePaste(t *testing.T) {
+	resetStore()
+
+	// Binary data can't be cloned, and no lines can be selected from it,
+	w := do("POST", "/api?burn=true", "\x00\x01\x02binary",
+		map[string]string{"Content-Type": "application/octet-stream"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload : got %d (%s)", w.Code, w.Body.String())
+	}
+	var binary Response
+	if err := json.NewDecoder(w.Body).Decode(&binary); err != nil {
+		t.Fatal(err)
+	}
+	if !binary.Binary || !binary.Burn {
+		t.Fatalf("unexpected response %+v", binary)
+	}
+
+	if w := do("GET", "/clone/"+binary.Id, "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("clone of binary : got %d", w.Code)
+	}
+	if w := do("GET", "/raw/"+binary.Id+"?lines=1", "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("lines of binary : got %d", w.Code)
+	}
+
+	// A bundle can't be cloned, and files that aren't in it aren't found,
+	bundle := save(t, map[string]interface{}{"maxviews": "1", "files": []map[string]string{
+		{"filename": "a.txt", "paste": "first"},
+		{"filename": "b.txt", "paste": "second"},
+	}})
+
+	if w := do("GET", "/clone/"+bundle.Id, "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("clone of bundle : got %d", w.Code)
+	}
+	if w := do("GET", "/raw/"+bundle.Id+"/c.txt", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing file : got %d", w.Code)
+	}
+	if w := do("GET", "/diff/"+bundle.Id+"/"+binary.Id, "", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("diff of bundle : got %d", w.Code)
+	}
+
+	// None of that used up the pastes,
+	if code, _ := raw(binary.Id, nil); code != http.StatusOK {
+		t.Fatalf("binary paste : got %d", code)
+	}
+	code, body := raw(bundle.Id+"/b.txt", nil)
+	if code != http.StatusOK || body != "second" {
+		t.Fatalf("file of bundle : got %d %q", code, body)
+	}
+}
+
+func TestLongPassword(t *testing.T) {
+	resetStore()
+
+	long := strings.Repeat("x", maxPasswordLength+1)
+	w := do("POST", "/api", `{"paste": "protected", "password": "`+long+`"}`,
+		map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("long password : got %d", w.Code)
+	}
+
+	w = do("POST", "/api?password="+long, "protected",
+		map[string]string{"Content-Type": "text/plain"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("long password upload : got %d", w.Code)
+	}
+
+	// The longest one is fine,
+	saved := save(t, map[string]interface{}{"paste": "protected",
+		"password": long[1:]})
+	if code, _ := raw(saved.Id, map[string]string{passwordHeader: long[1:]}); code != http.StatusOK {
+		t.Fatalf("longest password : got %d", code)
+	}
+}
+
+func TestUnlockCookie(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "protected", "password": "hunter2"})
+
+	w := do("POST", "/p/"+saved.Id, "password=hunter2",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("password form : got %d", w.Code)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == unlockCookieName(saved.Id) {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("no unlock cookie")
+	}
+	header := map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}
+
+	if code, _ := raw(saved.Id, header); code != http.StatusOK {
+		t.Fatalf("unlocked by cookie : got %d", code)
+	}
+
+	// A new paste that ends up with the same id isn't unlocked by the cookie,
+	p, err := store.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(saved.Id); err != nil {
+		t.Fatal(err)
+	}
+	p.Password, err = hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(p); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := raw(saved.Id, header); code != http.StatusUnauthorized {
+		t.Fatalf("reused id : got %d", code)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killProcessGroup only kills the command itself (which is what
+// exec.CommandContext does) since there are no process groups to kill.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = time.Second
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// reaperBatchSize is the max number of pastes the reaper removes per query.
+const reaperBatchSize = 100
+
+// defaultReaperInterval is used when reaperinterval isn't set in config.json.
+const defaultReaperInterval = 60
+
+// reapedPastes counts the expired pastes removed by the reaper, it's exposed
+// on /metrics.
+var reapedPastes int64
+
+// reapExpired removes all pastes whose expiry date has passed, in batches of
+// reaperBatchSize. Returns the number of removed pastes.
+func reapExpired() int {
+
+	now := time.Now().Unix()
+	total := 0
+
+	for {
+		n, hashes, err := store.DeleteExpired(now, reaperBatchSize)
+		if err != nil {
+			debugLogger.Println("   Database error : " + err.Error())
+			break
+		}
+
+		// Their renderings are of no use anymore, neither are the ones of
+		// the files of bundles,
+		for _, hash := range hashes {
+			pasteCache.invalidate(hash)
+		}
+
+		total += n
+		if n < reaperBatchSize {
+			break
+		}
+	}
+
+	// Sessions that have ended goes as well,
+	if err := users.DeleteExpiredSessions(now); err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+	}
+
+	atomic.AddInt64(&reapedPastes, int64(total))
+	return total
+}
+
+// startReaper starts a goroutine that removes expired pastes every interval
+// seconds.
+func startReaper(interval int) {
+
+	if interval <= 0 {
+		interval = defaultReaperInterval
+	}
+	loggy(fmt.Sprintf("Starting reaper, removing expired pastes every %d seconds",
+		interval))
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			n := reapExpired()
+			if n > 0 {
+				debugLogger.Println(fmt.Sprintf("   Reaper removed %d expired pastes", n))
+			} else {
+				loggy("Reaper found no expired pastes.")
+			}
+			<-ticker.C
+		}
+	}()
+}
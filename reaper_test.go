@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapExpired(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+
+		now := time.Now().Unix()
+		for _, p := range []Paste{
+			{Id: "old1", Hash: shaPaste("old1"), Data: "old1", Expiry: now - 10, Revision: 1},
+			{Id: "old2", Hash: shaPaste("old2"), Data: "old2", Expiry: now - 10, Revision: 1},
+			{Id: "current", Hash: shaPaste("current"), Data: "current", Expiry: now + 3600,
+				Revision: 1},
+			{Id: "forever", Hash: shaPaste("forever"), Data: "forever", Revision: 1},
+		} {
+			if err := store.Save(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The hashes of the removed pastes come back, no more than asked for,
+		n, hashes, err := store.DeleteExpired(now, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || len(hashes) != 1 || (hashes[0] != shaPaste("old1") && hashes[0] != shaPaste("old2")) {
+			t.Fatalf("deleted : got %v", hashes)
+		}
+		left := "old1"
+		if hashes[0] == shaPaste("old1") {
+			left = "old2"
+		}
+
+		// The reaper takes the rest, along with their renderings,
+		pasteCache.put(shaPaste(left), "go", "monokai", nil, rendered{Html: left})
+		if n := reapExpired(); n != 1 {
+			t.Fatalf("reaped : got %d", n)
+		}
+		if _, ok := pasteCache.get(shaPaste(left), "go", "monokai", nil); ok {
+			t.Fatalf("rendering of the reaped paste is still cached")
+		}
+
+		for id, want := range map[string]error{"old1": ErrNotFound, "old2": ErrNotFound,
+			"current": nil, "forever": nil} {
+			if _, err := store.Get(id); err != want {
+				t.Fatalf("%s : got %v, want %v", id, err, want)
+			}
+		}
+		if n := reapExpired(); n != 0 {
+			t.Fatalf("reaped again : got %d", n)
+		}
+	})
+}
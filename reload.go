@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// The languages and styles of the highlighter. They're only ever replaced as
+// a whole (never changed in place) under listsMu, so whatever supportedLists
+// returns can be used without holding the lock.
+var listsMu sync.RWMutex
+var listOfLanguages []Language
+var listOfLangsFirst map[string]string
+var listOfLangsLast map[string]string
+var listOfStyles map[string]string
+
+// supportedLists returns the current prioritized languages, the rest of the
+// languages and the styles.
+func supportedLists() (map[string]string, map[string]string, map[string]string) {
+	listsMu.RLock()
+	defer listsMu.RUnlock()
+	return listOfLangsFirst, listOfLangsLast, listOfStyles
+}
+
+// supportedLanguages returns all the current languages.
+func supportedLanguages() []Language {
+	listsMu.RLock()
+	defer listsMu.RUnlock()
+	return listOfLanguages
+}
+
+// reloadLists gets the languages and styles from the highlighter and
+// assets/prio-lexers again. The current lists are kept if anything fails.
+func reloadLists() error {
+
+	langs, err := getSupportedLangs()
+	if err != nil {
+		return err
+	}
+
+	// The description is the key and the actual lexer is the value, as that's
+	// what the html-template wants,
+	first := make(map[string]string)
+	last := make(map[string]string)
+	for _, l := range langs {
+		if l.Prioritized {
+			first[l.DisplayName] = l.Alias
+		} else {
+			last[l.DisplayName] = l.Alias
+		}
+	}
+
+	styles, err := getSupportedStyles()
+	if err != nil {
+		return err
+	}
+
+	listsMu.Lock()
+	listOfLanguages = langs
+	listOfLangsFirst, listOfLangsLast, listOfStyles = first, last, styles
+	listsMu.Unlock()
+
+	loggy(fmt.Sprintf("Loaded %d languages and %d styles",
+		len(first)+len(last), len(styles)))
+	return nil
+}
+
+// reloadOnSighup starts a goroutine that reloads the lists every time the
+// process gets a SIGHUP.
+func reloadOnSighup() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			debugLogger.Println("   Got SIGHUP, reloading languages and styles.")
+			if err := reloadLists(); err != nil {
+				debugLogger.Println("   Reload failed, keeping the old lists : " +
+					err.Error())
+			}
+		}
+	}()
+}
+
+// ReloadHandler reloads the lists on request. It needs the admintoken from
+// config.json as a bearer token, and doesn't exist at all without one.
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if configuration.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	given := []byte(r.Header.Get("Authorization"))
+	wanted := []byte("Bearer " + configuration.AdminToken)
+	if subtle.ConstantTimeCompare(given, wanted) != 1 {
+		loggy("Wrong or no admin token given.")
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	if err := reloadLists(); err != nil {
+		debugLogger.Println("   Reload failed, keeping the old lists : " +
+			err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	first, last, styles := supportedLists()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"languages": len(first) + len(last),
+		"styles":    len(styles),
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// Routing,
+	"github.com/gorilla/mux"
+)
+
+// RevisionInfo describes a revision of a paste, without the data.
+type RevisionInfo struct {
+	Created  string `json:"created"`  // When the revision was saved, "" if unknown
+	Revision int    `json:"revision"` // The number of the revision, starting at 1
+	Sha1     string `json:"sha1"`     // The sha1 of the revision
+	Size     int    `json:"size"`     // The length of the revision
+	Title    string `json:"title"`    // The title of the revision
+	Url      string `json:"url"`      // The url of the revision
+}
+
+// requestedRevision returns the revision in the url (/p/{id}/rev/{n}), 0 if
+// there is none which means the latest one. Anything that isn't a revision
+// number gives -1, which never exists.
+func requestedRevision(r *http.Request) int {
+
+	rev, ok := mux.Vars(r)["rev"]
+	if !ok {
+		return 0
+	}
+
+	n, err := strconv.Atoi(rev)
+	if err != nil || n < 1 {
+		return -1
+	}
+	return n
+}
+
+// parsePasteRef splits a reference to a paste, either just the id (the
+// latest revision) or id@revision.
+func parsePasteRef(ref string) (string, int, error) {
+
+	id, rev, ok := strings.Cut(ref, "@")
+	if !ok {
+		return id, 0, nil
+	}
+
+	n, err := strconv.Atoi(rev)
+	if err != nil || n < 1 {
+		return "", 0, fmt.Errorf("invalid revision '%s'", rev)
+	}
+	return id, n, nil
+}
+
+// revisionSaved returns when the latest revision of the paste was saved,
+// which is when it was edited unless it never was. Older revisions only have
+// the created date, which is when they were saved.
+func revisionSaved(p Paste) int64 {
+	if p.Edited != 0 {
+		return p.Edited
+	}
+	return p.Created
+}
+
+// revisionInfo returns the description of a revision.
+func revisionInfo(p Paste, hostname string) RevisionInfo {
+
+	created := ""
+	if saved := revisionSaved(p); saved != 0 {
+		created = time.Unix(saved, 0).Format("2006-01-02 15:04:05")
+	}
+
+	return RevisionInfo{
+		Created:  created,
+		Revision: p.Revision,
+		Sha1:     p.Hash,
+		Size:     len(p.Data),
+		Title:    p.Title,
+		Url:      fmt.Sprintf("%s/p/%s/rev/%d", hostname, p.Id, p.Revision),
+	}
+}
+
+// revisionList returns all the revisions of the paste, oldest first. The
+// latest one is missing if the paste was removed by this very view (burned
+// or no views left).
+func revisionList(pasteId string, hostname string) []RevisionInfo {
+
+	older, err := store.Revisions(pasteId)
+	if err != nil {
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	var list []RevisionInfo
+	for _, p := range older {
+		list = append(list, revisionInfo(p, hostname))
+	}
+
+	latest, err := store.Get(pasteId)
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	default:
+		list = append(list, revisionInfo(latest, hostname))
+	}
+
+	return list
+}
+
+// EditHandler saves a new revision of a paste, the delkey of the paste is
+// needed unless the owner is logged in. The paste is sent the same way as to
+// SaveHandler, and the title, file name and style of the current revision are
+// kept unless new ones are given. Expiry, burn, view limit and password can't
+// be changed.
+func EditHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pasteId := vars["pasteId"]
+
+	loggy(fmt.Sprintf("Recieving request to edit paste '%s', trying to parse indata.",
+		pasteId))
+
+	inData, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := store.Get(pasteId)
+	switch {
+	case err == ErrNotFound:
+		notfoundHandler(w, pasteId)
+		return
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	if !checkPasteExpiry(pasteId, p.Expiry) {
+		notfoundHandler(w, pasteId)
+		return
+	}
+
+	if !mayChange(r, p, inData.DelKey) {
+		loggy("Given delkey doesn't match the one of the paste.")
+		http.Error(w, "Wrong delkey.", http.StatusForbidden)
+		return
+	}
+
+	// There's no way to diff or show revisions of binary data or bundles, and
+	// the key of an encrypted paste must stay the same for all revisions,
+	if p.Binary || inData.Binary {
+		http.Error(w, "Binary pastes can't be edited.", http.StatusBadRequest)
+		return
+	}
+	if len(inData.Files) > 0 || len(pasteFiles(pasteId)) > 0 {
+		http.Error(w, "Bundles can't be edited.", http.StatusBadRequest)
+		return
+	}
+	if p.Encrypted != inData.Encrypted {
+		http.Error(w, "An encrypted paste can only be replaced by encrypted data, and the other way around.",
+			http.StatusBadRequest)
+		return
+	}
+
+	if inData.Title == "" {
+		inData.Title = p.Title
+	}
+	if inData.Filename == "" {
+		inData.Filename = p.Filename
+	}
+	if inData.Style == "" {
+		inData.Style = p.Style
+	}
+
+	remaining := -1
+	if p.MaxViews > 0 {
+		remaining = p.MaxViews - p.Views
+	}
+
+	resp := Response{
+		Encrypted:      p.Encrypted,
+		Burn:           p.Burn,
+		Protected:      p.Password != "",
+		RemainingViews: remaining,
+		Id:             pasteId,
+		Mime:           "text/plain; charset=utf-8",
+		Url:            requestHost(r) + "/p/" + pasteId,
+	}
+
+	// Nothing to save if nothing changed,
+	sha := shaPaste(inData.Paste)
+	lang := pasteLang(inData)
+	if sha == p.Hash && inData.Title == p.Title && lang == p.Lang &&
+		inData.Style == p.Style && inData.Filename == p.Filename {
+		loggy("Edit doesn't change the paste, keeping the current revision.")
+		resp.Status = "Paste data is unchanged."
+		resp.Title, resp.Filename, resp.Lang, resp.Style = p.Title, p.Filename,
+			p.Lang, p.Style
+		resp.Sha1, resp.Size, resp.Revision = p.Hash, len(p.Data), p.Revision
+		writeSaved(w, r, resp)
+		return
+	}
+
+	np, err := store.Revise(Paste{
+		Id:       pasteId,
+		Title:    inData.Title,
+		Hash:     sha,
+		Data:     inData.Paste,
+		Lang:     lang,
+		Style:    inData.Style,
+		Filename: inData.Filename,
+		Edited:   time.Now().Unix(),
+	})
+	switch {
+	case err == ErrNotFound:
+		notfoundHandler(w, pasteId)
+		return
+	case err != nil:
+		debugLogger.Println("   Database error : " + err.Error())
+		os.Exit(1)
+	}
+
+	// The old rendering isn't the latest anymore, and older revisions are
+	// never cached,
+	pasteCache.invalidate(p.Hash)
+
+	loggy(fmt.Sprintf("Saved revision %d of paste '%s'.", np.Revision, pasteId))
+
+	resp.Status = fmt.Sprintf("Saved revision %d.", np.Revision)
+	resp.Title, resp.Filename, resp.Lang, resp.Style = np.Title, np.Filename,
+		np.Lang, np.Style
+	resp.Sha1, resp.Size, resp.Revision = np.Hash, len(np.Data), np.Revision
+	writeSaved(w, r, resp)
+}
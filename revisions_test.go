@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"title": "Notes", "paste": "first\n"})
+	header := map[string]string{"Content-Type": "application/json"}
+
+	w := do("PUT", "/api/"+saved.Id, `{"paste": "second\n", "delkey": "wrong"}`, header)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("wrong delkey : got %d", w.Code)
+	}
+
+	w = do("PUT", "/api/"+saved.Id, `{"paste": "second\n", "delkey": "`+saved.DelKey+`"}`,
+		header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit : got %d (%s)", w.Code, w.Body.String())
+	}
+	var edited Response
+	if err := json.NewDecoder(w.Body).Decode(&edited); err != nil {
+		t.Fatal(err)
+	}
+	if edited.Revision != 2 || edited.Title != "Notes" {
+		t.Fatalf("edited : got %+v", edited)
+	}
+
+	if code, body := raw(saved.Id, nil); code != http.StatusOK || body != "second\n" {
+		t.Fatalf("latest : got %d %q", code, body)
+	}
+	if code, body := raw(saved.Id+"/rev/1", nil); code != http.StatusOK || body != "first\n" {
+		t.Fatalf("revision 1 : got %d %q", code, body)
+	}
+	if code, _ := raw(saved.Id+"/rev/3", nil); code != http.StatusNotFound {
+		t.Fatalf("revision 3 : got %d", code)
+	}
+
+	w = do("GET", "/api/"+saved.Id, "", nil)
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Revisions) != 2 {
+		t.Fatalf("revisions : got %+v", p.Revisions)
+	}
+}
+
+func TestEditKeepsCreated(t *testing.T) {
+	resetStore()
+
+	saved := save(t, map[string]interface{}{"paste": "package main\n", "lang": "go",
+		"style": "monokai", "filename": "main.go"})
+	before, err := store.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := map[string]string{"Content-Type": "application/json"}
+	edit := func(fields string) Response {
+		t.Helper()
+		w := do("PUT", "/api/"+saved.Id, `{"paste": "package main\n", "lang": "go", `+
+			fields+`"delkey": "`+saved.DelKey+`"}`, header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("edit : got %d (%s)", w.Code, w.Body.String())
+		}
+		var p Response
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// The same data, title, language, style and file name changes nothing,
+	if p := edit(""); p.Revision != 1 {
+		t.Fatalf("unchanged edit : got revision %d", p.Revision)
+	}
+
+	// Any of them on its own is a new revision,
+	for i, fields := range []string{`"style": "vim", `, `"filename": "other.go", `,
+		`"lang": "c", "filename": "other.go", `} {
+		if p := edit(fields); p.Revision != i+2 {
+			t.Fatalf("edit of %s : got revision %d", fields, p.Revision)
+		}
+	}
+
+	after, err := store.Get(saved.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Created != before.Created || after.Edited < before.Created {
+		t.Fatalf("created %d and edited %d, was created %d", after.Created,
+			after.Edited, before.Created)
+	}
+}
@@ -0,0 +1,1015 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by a PasteStore when the requested paste doesn't
+// exist.
+var ErrNotFound = errors.New("paste not found")
+
+// ErrUserExists is returned by a UserStore when a user with the same name is
+// already stored.
+var ErrUserExists = errors.New("user already exists")
+
+// Paste is a single paste as it is kept by a PasteStore.
+type Paste struct {
+	Id        string // The id of the paste
+	Title     string // The title of the paste
+	Hash      string // The sha1 of the paste data
+	Data      string // The actual paste data
+	DelKey    string // The key needed to delete the paste
+	Expiry    int64  // The expiry date in epoch time, 0 means never
+	Burn      bool   // If the paste is deleted after the first view
+	MaxViews  int    // The number of views allowed, 0 means unlimited
+	Views     int    // The number of views so far (only counted with MaxViews)
+	Encrypted bool   // If the data is ciphertext encrypted by the client
+	Password  string // The bcrypt hash of the password, "" if there is none
+	Mime      string // The mime type of the data
+	Binary    bool   // If the data is binary (stored as a blob)
+	Lang      string // The language given or detected when saving, "" if unknown
+	Style     string // The style given when saving, "" if none
+	Filename  string // The file name given when saving, "" if none
+	Revision  int    // The revision of the data, starting at 1
+	Created   int64  // When the paste (or an older revision) was saved in epoch time, 0 if unknown
+	Edited    int64  // When the latest revision was saved in epoch time, 0 if never edited
+	Parent    string // The id of the paste this is a fork of, "" if none
+	ParentRev int    // The revision of the parent that was forked
+	Files     []File // The other files of a bundle (only when saving)
+	Owner     string // The name of the user that saved the paste, "" if anonymous
+}
+
+// File is one of the files of a bundle, except the first one which is kept
+// in the paste itself.
+type File struct {
+	Filename string // The name of the file, unique within the bundle
+	Lang     string // The language given or detected when saving, "" if unknown
+	Hash     string // The sha1 of the file data
+	Data     string // The actual file data
+}
+
+// User is a local account.
+type User struct {
+	Name     string // The name of the user, unique
+	Password string // The bcrypt hash of the password
+	Created  int64  // When the account was created in epoch time
+}
+
+// Session is a browser that is logged in.
+type Session struct {
+	Token  string // The sha256 of the token in the cookie
+	User   string // The name of the logged in user
+	Expiry int64  // When the session ends in epoch time
+}
+
+// PasteStore is the interface that every storage backend implements. The
+// handlers only talk to the database through this, which means that a new
+// backend only has to implement these methods.
+type PasteStore interface {
+	// Save inserts a new paste, together with the other files if it's a
+	// bundle.
+	Save(p Paste) error
+
+	// Get returns the paste with the given id, or ErrNotFound.
+	Get(id string) (Paste, error)
+
+	// Delete removes the paste with the given id, or returns ErrNotFound.
+	Delete(id string) error
+
+	// Exists reports whether a paste with the given id is stored.
+	Exists(id string) (bool, error)
+
+	// FindByHash returns the paste with the given hash, or ErrNotFound.
+	FindByHash(hash string) (Paste, error)
+
+	// View registers a view of a paste that has a view limit. The view
+	// counter is increased and the paste is removed when the limit is
+	// reached, all in one atomic operation. Returns the paste as seen by this
+	// view, or ErrNotFound if it doesn't exist or has no views left.
+	View(id string) (Paste, error)
+
+	// DeleteExpired removes at most limit pastes that have an expiry date
+	// before or at now. Returns the number of removed pastes and the hashes
+	// of their data, together with the hashes of the other files of bundles.
+	DeleteExpired(now int64, limit int) (int, []string, error)
+
+	// Revise saves the title, data, hash, language, style, file name and
+	// edited date of p as a new revision of the paste with the same id. The
+	// current ones are kept as an older revision, with the date it was saved
+	// as its created date. The created date of the paste stays. Returns the
+	// paste with the new revision, or ErrNotFound.
+	Revise(p Paste) (Paste, error)
+
+	// Revisions returns the older revisions of the paste, oldest first. Only
+	// the fields that Revise changes are set.
+	Revisions(id string) ([]Paste, error)
+
+	// GetRevision returns an older revision of the paste, or ErrNotFound.
+	// Only the fields that Revise changes are set.
+	GetRevision(id string, revision int) (Paste, error)
+
+	// Forks returns the pastes that are forked from the paste with the given
+	// id, ordered by id.
+	Forks(id string) ([]Paste, error)
+
+	// Files returns the other files of a bundle in the order they were
+	// given, none if the paste is a single file.
+	Files(id string) ([]File, error)
+}
+
+// UserStore is the interface for the accounts and their sessions, every
+// storage backend implements it next to PasteStore.
+type UserStore interface {
+	// Owned returns the pastes saved by the user, newest first. The other
+	// files of bundles are set, without their data.
+	Owned(owner string) ([]Paste, error)
+
+	// SaveUser inserts a new user, or returns ErrUserExists.
+	SaveUser(u User) error
+
+	// GetUser returns the user with the given name, or ErrNotFound.
+	GetUser(name string) (User, error)
+
+	// SaveSession inserts a new session.
+	SaveSession(sess Session) error
+
+	// GetSession returns the session with the given token, or ErrNotFound.
+	GetSession(token string) (Session, error)
+
+	// DeleteSession removes the session with the given token, if any.
+	DeleteSession(token string) error
+
+	// DeleteExpiredSessions removes the sessions that ended before or at now.
+	DeleteExpiredSessions(now int64) error
+}
+
+//
+// SQL store (sqlite3, postgres and mysql),
+//
+
+// sqlStore is a PasteStore and UserStore backed by one of the supported sql
+// databases.
+type sqlStore struct {
+	db     *sql.DB
+	dbType string
+	table  string
+}
+
+// revisionsTable returns the table that holds the older revisions.
+func (s *sqlStore) revisionsTable() string {
+	return s.table + "_revisions"
+}
+
+// filesTable returns the table that holds the other files of bundles.
+func (s *sqlStore) filesTable() string {
+	return s.table + "_files"
+}
+
+// usersTable returns the table that holds the users.
+func (s *sqlStore) usersTable() string {
+	return s.table + "_users"
+}
+
+// sessionsTable returns the table that holds the sessions.
+func (s *sqlStore) sessionsTable() string {
+	return s.table + "_sessions"
+}
+
+// extraTables returns the tables with rows that belongs to a paste, which
+// are removed together with it.
+func (s *sqlStore) extraTables() []string {
+	return []string{s.revisionsTable(), s.filesTable()}
+}
+
+// newSQLStore returns a PasteStore and UserStore that uses the given
+// database handle.
+func newSQLStore(db *sql.DB, dbType string, table string) *sqlStore {
+	return &sqlStore{db: db, dbType: dbType, table: table}
+}
+
+// placeholder returns the i:th (starting at 1) placeholder for the database
+// driver, since postgres uses $[i] and the others uses ?.
+func placeholder(dbType string, i int) string {
+	if dbType == "postgres" {
+		return "$" + strconv.Itoa(i)
+	}
+	return "?"
+}
+
+// ph returns the i:th (starting at 1) placeholder of the store.
+func (s *sqlStore) ph(i int) string {
+	return placeholder(s.dbType, i)
+}
+
+// phs returns a comma separated list of n placeholders.
+func (s *sqlStore) phs(n int) string {
+	var p []string
+	for i := 1; i <= n; i++ {
+		p = append(p, s.ph(i))
+	}
+	return strings.Join(p, ",")
+}
+
+// pasteColumns is the list of columns that is selected and scanned with
+// scanPaste.
+const pasteColumns = "id, title, hash, data, delkey, expiry, burn, " +
+	"max_views, views, encrypted, password, mime, bin, lang, style, filename, " +
+	"revision, created, parent, parent_revision, owner, edited"
+
+// revisionColumns is the list of columns of the older revisions that is
+// selected and scanned with scanRevision.
+const revisionColumns = "id, revision, title, hash, data, lang, style, " +
+	"filename, created"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPaste scans a row selected with pasteColumns into a Paste.
+func scanPaste(row rowScanner) (Paste, error) {
+	var p Paste
+	var title, hash, data, delkey, password, mimeType, lang, style,
+		filename, parent, owner sql.NullString
+	var expiry sql.NullInt64
+	var bin []byte
+
+	err := row.Scan(&p.Id, &title, &hash, &data, &delkey, &expiry, &p.Burn,
+		&p.MaxViews, &p.Views, &p.Encrypted, &password, &mimeType, &bin, &lang,
+		&style, &filename, &p.Revision, &p.Created, &parent, &p.ParentRev,
+		&owner, &p.Edited)
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+
+	// Binary pastes are kept in the bin column, text in the data column,
+	p.Data = data.String
+	if bin != nil {
+		p.Data = string(bin)
+		p.Binary = true
+	}
+
+	p.Title = title.String
+	p.Hash = hash.String
+	p.DelKey = delkey.String
+	p.Expiry = expiry.Int64
+	p.Password = password.String
+	p.Mime = mimeType.String
+	p.Lang = lang.String
+	p.Style = style.String
+	p.Filename = filename.String
+	p.Parent = parent.String
+	p.Owner = owner.String
+	return p, err
+}
+
+// scanRevision scans a row selected with revisionColumns into a Paste.
+func scanRevision(row rowScanner) (Paste, error) {
+	var p Paste
+	var title, hash, data, lang, style, filename sql.NullString
+
+	err := row.Scan(&p.Id, &p.Revision, &title, &hash, &data, &lang, &style,
+		&filename, &p.Created)
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+
+	p.Title = title.String
+	p.Hash = hash.String
+	p.Data = data.String
+	p.Lang = lang.String
+	p.Style = style.String
+	p.Filename = filename.String
+	return p, err
+}
+
+func (s *sqlStore) Save(p Paste) error {
+	var data interface{} = p.Data
+	var bin []byte
+	if p.Binary {
+		data = nil
+		bin = []byte(p.Data)
+	}
+
+	if p.Revision == 0 {
+		p.Revision = 1
+	}
+
+	// Pastes that aren't forks have no parent at all, and anonymous pastes
+	// no owner,
+	var parent, owner interface{}
+	if p.Parent != "" {
+		parent = p.Parent
+	}
+	if p.Owner != "" {
+		owner = p.Owner
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO "+s.table+" ("+pasteColumns+") values("+
+		s.phs(22)+")", p.Id, p.Title, p.Hash, data, p.DelKey, p.Expiry, p.Burn,
+		p.MaxViews, p.Views, p.Encrypted, p.Password, p.Mime, bin, p.Lang,
+		p.Style, p.Filename, p.Revision, p.Created, parent, p.ParentRev, owner,
+		p.Edited)
+	if err != nil {
+		return err
+	}
+
+	// The first file of a bundle is the paste itself,
+	for i, f := range p.Files {
+		_, err = tx.Exec("INSERT INTO "+s.filesTable()+" (id, position, "+
+			"filename, lang, hash, data) values("+s.phs(6)+")", p.Id, i+1,
+			f.Filename, f.Lang, f.Hash, f.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) Get(id string) (Paste, error) {
+	return scanPaste(s.db.QueryRow("select "+pasteColumns+" from "+s.table+
+		" where id="+s.ph(1), id))
+}
+
+func (s *sqlStore) Delete(id string) error {
+	res, err := s.db.Exec("delete from "+s.table+" where id="+s.ph(1), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	for _, table := range s.extraTables() {
+		_, err = s.db.Exec("delete from "+table+" where id="+s.ph(1), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Exists(id string) (bool, error) {
+	var dummy string
+	err := s.db.QueryRow("select id from "+s.table+" where id="+s.ph(1), id).
+		Scan(&dummy)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqlStore) FindByHash(hash string) (Paste, error) {
+	return scanPaste(s.db.QueryRow("select "+pasteColumns+" from "+s.table+
+		" where hash="+s.ph(1), hash))
+}
+
+func (s *sqlStore) View(id string) (Paste, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Paste{}, err
+	}
+	defer tx.Rollback()
+
+	// The update only succeeds while there are views left, and it locks the
+	// row for the rest of the transaction so nobody else can sneak in,
+	res, err := tx.Exec("update "+s.table+" set views = views + 1 where id="+
+		s.ph(1)+" and (max_views = 0 or views < max_views)", id)
+	if err != nil {
+		return Paste{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Paste{}, err
+	}
+	if n == 0 {
+		return Paste{}, ErrNotFound
+	}
+
+	p, err := scanPaste(tx.QueryRow("select "+pasteColumns+" from "+s.table+
+		" where id="+s.ph(1), id))
+	if err != nil {
+		return Paste{}, err
+	}
+
+	// This was the last view, remove the paste,
+	if p.MaxViews > 0 && p.Views >= p.MaxViews {
+		_, err = tx.Exec("delete from "+s.table+" where id="+s.ph(1), id)
+		if err != nil {
+			return Paste{}, err
+		}
+		for _, table := range s.extraTables() {
+			_, err = tx.Exec("delete from "+table+" where id="+s.ph(1), id)
+			if err != nil {
+				return Paste{}, err
+			}
+		}
+	}
+
+	return p, tx.Commit()
+}
+
+func (s *sqlStore) DeleteExpired(now int64, limit int) (int, []string, error) {
+	// Not all databases supports limit in a delete, so pick the ids first,
+	rows, err := s.db.Query("select id, hash from "+s.table+" where expiry != 0"+
+		" and expiry <= "+s.ph(1)+" limit "+strconv.Itoa(limit), now)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var ids []interface{}
+	var hashes []string
+	for rows.Next() {
+		var id string
+		var hash sql.NullString
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+		hashes = append(hashes, hash.String)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	// The files of bundles are cached by their own hashes,
+	var in []string
+	for i := range ids {
+		in = append(in, s.ph(i+1))
+	}
+	rows, err = s.db.Query("select hash from "+s.filesTable()+" where id in ("+
+		strings.Join(in, ",")+")", ids...)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var hash sql.NullString
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		hashes = append(hashes, hash.String)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	in = in[:0]
+	for i := range ids {
+		in = append(in, s.ph(i+2))
+	}
+
+	_, err = s.db.Exec("delete from "+s.table+" where expiry != 0 and "+
+		"expiry <= "+s.ph(1)+" and id in ("+strings.Join(in, ",")+")",
+		append([]interface{}{now}, ids...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// The expiry can't change, so every picked paste is gone now,
+	in = in[:0]
+	for i := range ids {
+		in = append(in, s.ph(i+1))
+	}
+	for _, table := range s.extraTables() {
+		_, err = s.db.Exec("delete from "+table+" where id in ("+
+			strings.Join(in, ",")+")", ids...)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return len(ids), hashes, nil
+}
+
+func (s *sqlStore) Revise(p Paste) (Paste, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Paste{}, err
+	}
+	defer tx.Rollback()
+
+	// Bumping the revision locks the row, so two edits can't get the same
+	// revision,
+	res, err := tx.Exec("update "+s.table+" set revision = revision + 1 where id="+
+		s.ph(1), p.Id)
+	if err != nil {
+		return Paste{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Paste{}, err
+	}
+	if n == 0 {
+		return Paste{}, ErrNotFound
+	}
+
+	old, err := scanPaste(tx.QueryRow("select "+pasteColumns+" from "+s.table+
+		" where id="+s.ph(1), p.Id))
+	if err != nil {
+		return Paste{}, err
+	}
+
+	_, err = tx.Exec("insert into "+s.revisionsTable()+" ("+revisionColumns+
+		") values("+s.phs(9)+")", old.Id, old.Revision-1, old.Title, old.Hash,
+		old.Data, old.Lang, old.Style, old.Filename, revisionSaved(old))
+	if err != nil {
+		return Paste{}, err
+	}
+
+	_, err = tx.Exec("update "+s.table+" set title="+s.ph(1)+", hash="+s.ph(2)+
+		", data="+s.ph(3)+", lang="+s.ph(4)+", style="+s.ph(5)+", filename="+
+		s.ph(6)+", edited="+s.ph(7)+" where id="+s.ph(8), p.Title, p.Hash,
+		p.Data, p.Lang, p.Style, p.Filename, p.Edited, p.Id)
+	if err != nil {
+		return Paste{}, err
+	}
+
+	old.Title, old.Hash, old.Data = p.Title, p.Hash, p.Data
+	old.Lang, old.Style, old.Filename = p.Lang, p.Style, p.Filename
+	old.Edited = p.Edited
+	return old, tx.Commit()
+}
+
+func (s *sqlStore) Revisions(id string) ([]Paste, error) {
+	rows, err := s.db.Query("select "+revisionColumns+" from "+
+		s.revisionsTable()+" where id="+s.ph(1)+" order by revision", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Paste
+	for rows.Next() {
+		p, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, p)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *sqlStore) GetRevision(id string, revision int) (Paste, error) {
+	return scanRevision(s.db.QueryRow("select "+revisionColumns+" from "+
+		s.revisionsTable()+" where id="+s.ph(1)+" and revision="+s.ph(2),
+		id, revision))
+}
+
+func (s *sqlStore) Forks(id string) ([]Paste, error) {
+	rows, err := s.db.Query("select "+pasteColumns+" from "+s.table+
+		" where parent="+s.ph(1)+" order by id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var forks []Paste
+	for rows.Next() {
+		p, err := scanPaste(rows)
+		if err != nil {
+			return nil, err
+		}
+		forks = append(forks, p)
+	}
+	return forks, rows.Err()
+}
+
+func (s *sqlStore) Files(id string) ([]File, error) {
+	rows, err := s.db.Query("select filename, lang, hash, data from "+
+		s.filesTable()+" where id="+s.ph(1)+" order by position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		var lang, hash, data sql.NullString
+		if err := rows.Scan(&f.Filename, &lang, &hash, &data); err != nil {
+			return nil, err
+		}
+		f.Lang, f.Hash, f.Data = lang.String, hash.String, data.String
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func (s *sqlStore) Owned(owner string) ([]Paste, error) {
+	rows, err := s.db.Query("select "+pasteColumns+" from "+s.table+
+		" where owner="+s.ph(1)+" order by created desc, id", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pastes []Paste
+	index := make(map[string]int)
+	for rows.Next() {
+		p, err := scanPaste(rows)
+		if err != nil {
+			return nil, err
+		}
+		index[p.Id] = len(pastes)
+		pastes = append(pastes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// The files of all the bundles at once,
+	rows, err = s.db.Query("select id, filename, lang, hash from "+
+		s.filesTable()+" where id in (select id from "+s.table+" where owner="+
+		s.ph(1)+") order by id, position", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var f File
+		var lang, hash sql.NullString
+		if err := rows.Scan(&id, &f.Filename, &lang, &hash); err != nil {
+			return nil, err
+		}
+		f.Lang, f.Hash = lang.String, hash.String
+		if i, ok := index[id]; ok {
+			pastes[i].Files = append(pastes[i].Files, f)
+		}
+	}
+	return pastes, rows.Err()
+}
+
+func (s *sqlStore) SaveUser(u User) error {
+	_, err := s.db.Exec("insert into "+s.usersTable()+" (name, password, "+
+		"created) values("+s.phs(3)+")", u.Name, u.Password, u.Created)
+	if err == nil {
+		return nil
+	}
+
+	// The drivers don't agree on how a duplicate key is reported, so just
+	// look for the user,
+	if _, getErr := s.GetUser(u.Name); getErr == nil {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (s *sqlStore) GetUser(name string) (User, error) {
+	var u User
+	err := s.db.QueryRow("select name, password, created from "+
+		s.usersTable()+" where name="+s.ph(1), name).Scan(&u.Name,
+		&u.Password, &u.Created)
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+func (s *sqlStore) SaveSession(sess Session) error {
+	_, err := s.db.Exec("insert into "+s.sessionsTable()+" (token, name, "+
+		"expiry) values("+s.phs(3)+")", sess.Token, sess.User, sess.Expiry)
+	return err
+}
+
+func (s *sqlStore) GetSession(token string) (Session, error) {
+	var sess Session
+	err := s.db.QueryRow("select token, name, expiry from "+
+		s.sessionsTable()+" where token="+s.ph(1), token).Scan(&sess.Token,
+		&sess.User, &sess.Expiry)
+	if err == sql.ErrNoRows {
+		return sess, ErrNotFound
+	}
+	return sess, err
+}
+
+func (s *sqlStore) DeleteSession(token string) error {
+	_, err := s.db.Exec("delete from "+s.sessionsTable()+" where token="+
+		s.ph(1), token)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredSessions(now int64) error {
+	_, err := s.db.Exec("delete from "+s.sessionsTable()+" where expiry <= "+
+		s.ph(1), now)
+	return err
+}
+
+//
+// Memory store,
+//
+
+// memoryStore is a PasteStore and UserStore that keeps everything in memory. Nothing
+// survives a restart, so it's mostly useful for testing and development.
+type memoryStore struct {
+	mu        sync.RWMutex
+	pastes    map[string]Paste
+	revisions map[string][]Paste
+	files     map[string][]File
+	users     map[string]User
+	sessions  map[string]Session
+}
+
+// newMemoryStore returns an empty in-memory PasteStore and UserStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		pastes:    make(map[string]Paste),
+		revisions: make(map[string][]Paste),
+		files:     make(map[string][]File),
+		users:     make(map[string]User),
+		sessions:  make(map[string]Session),
+	}
+}
+
+func (m *memoryStore) Save(p Paste) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pastes[p.Id]; ok {
+		return errors.New("paste with id " + p.Id + " already exists")
+	}
+	if p.Revision == 0 {
+		p.Revision = 1
+	}
+	if len(p.Files) > 0 {
+		m.files[p.Id] = append([]File(nil), p.Files...)
+	}
+	p.Files = nil
+	m.pastes[p.Id] = p
+	return nil
+}
+
+func (m *memoryStore) Get(id string) (Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.pastes[id]
+	if !ok {
+		return Paste{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *memoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pastes[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.pastes, id)
+	delete(m.revisions, id)
+	delete(m.files, id)
+	return nil
+}
+
+func (m *memoryStore) Exists(id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.pastes[id]
+	return ok, nil
+}
+
+func (m *memoryStore) FindByHash(hash string) (Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, p := range m.pastes {
+		if p.Hash == hash {
+			return p, nil
+		}
+	}
+	return Paste{}, ErrNotFound
+}
+
+func (m *memoryStore) DeleteExpired(now int64, limit int) (int, []string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	var hashes []string
+	for id, p := range m.pastes {
+		if n >= limit {
+			break
+		}
+		if p.Expiry != 0 && p.Expiry <= now {
+			hashes = append(hashes, p.Hash)
+			for _, f := range m.files[id] {
+				hashes = append(hashes, f.Hash)
+			}
+			delete(m.pastes, id)
+			delete(m.revisions, id)
+			delete(m.files, id)
+			n++
+		}
+	}
+	return n, hashes, nil
+}
+
+func (m *memoryStore) View(id string) (Paste, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.pastes[id]
+	if !ok || (p.MaxViews > 0 && p.Views >= p.MaxViews) {
+		return Paste{}, ErrNotFound
+	}
+
+	p.Views++
+	if p.MaxViews > 0 && p.Views >= p.MaxViews {
+		delete(m.pastes, id)
+		delete(m.revisions, id)
+		delete(m.files, id)
+	} else {
+		m.pastes[id] = p
+	}
+	return p, nil
+}
+
+func (m *memoryStore) Revise(p Paste) (Paste, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cur, ok := m.pastes[p.Id]
+	if !ok {
+		return Paste{}, ErrNotFound
+	}
+
+	m.revisions[p.Id] = append(m.revisions[p.Id], Paste{
+		Id:       cur.Id,
+		Revision: cur.Revision,
+		Title:    cur.Title,
+		Hash:     cur.Hash,
+		Data:     cur.Data,
+		Lang:     cur.Lang,
+		Style:    cur.Style,
+		Filename: cur.Filename,
+		Created:  revisionSaved(cur),
+	})
+
+	cur.Title, cur.Hash, cur.Data = p.Title, p.Hash, p.Data
+	cur.Lang, cur.Style, cur.Filename = p.Lang, p.Style, p.Filename
+	cur.Edited = p.Edited
+	cur.Revision++
+	m.pastes[p.Id] = cur
+	return cur, nil
+}
+
+func (m *memoryStore) Revisions(id string) ([]Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Paste(nil), m.revisions[id]...), nil
+}
+
+func (m *memoryStore) GetRevision(id string, revision int) (Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, p := range m.revisions[id] {
+		if p.Revision == revision {
+			return p, nil
+		}
+	}
+	return Paste{}, ErrNotFound
+}
+
+func (m *memoryStore) Forks(id string) ([]Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var forks []Paste
+	for _, p := range m.pastes {
+		if p.Parent == id {
+			forks = append(forks, p)
+		}
+	}
+	sort.Slice(forks, func(i, j int) bool { return forks[i].Id < forks[j].Id })
+	return forks, nil
+}
+
+func (m *memoryStore) Files(id string) ([]File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]File(nil), m.files[id]...), nil
+}
+
+func (m *memoryStore) Owned(owner string) ([]Paste, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var pastes []Paste
+	for _, p := range m.pastes {
+		if p.Owner != owner {
+			continue
+		}
+		for _, f := range m.files[p.Id] {
+			f.Data = ""
+			p.Files = append(p.Files, f)
+		}
+		pastes = append(pastes, p)
+	}
+	sort.Slice(pastes, func(i, j int) bool {
+		if pastes[i].Created != pastes[j].Created {
+			return pastes[i].Created > pastes[j].Created
+		}
+		return pastes[i].Id < pastes[j].Id
+	})
+	return pastes, nil
+}
+
+func (m *memoryStore) SaveUser(u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[u.Name]; ok {
+		return ErrUserExists
+	}
+	m.users[u.Name] = u
+	return nil
+}
+
+func (m *memoryStore) GetUser(name string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[name]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *memoryStore) SaveSession(sess Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[sess.Token] = sess
+	return nil
+}
+
+func (m *memoryStore) GetSession(token string) (Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sess, ok := m.sessions[token]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return sess, nil
+}
+
+func (m *memoryStore) DeleteSession(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, token)
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredSessions(now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for token, sess := range m.sessions {
+		if sess.Expiry <= now {
+			delete(m.sessions, token)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestPasteStore checks that every backend behaves the same way.
+func TestPasteStore(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+
+		p := Paste{Id: "one", Title: "One", Hash: shaPaste("one\n"), Data: "one\n",
+			DelKey: "key", Expiry: 4102444800, Mime: "text/plain; charset=utf-8",
+			Lang: "go", Style: "monokai", Filename: "one.go", Revision: 1,
+			Created: 1700000000, Owner: "alice"}
+		if err := store.Save(p); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.Get("one")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Fatalf("get : got %+v, want %+v", got, p)
+		}
+		if _, err := store.Get("missing"); err != ErrNotFound {
+			t.Fatalf("get missing : got %v", err)
+		}
+		if found, err := store.FindByHash(p.Hash); err != nil || found.Id != "one" {
+			t.Fatalf("find by hash : got %q (%v)", found.Id, err)
+		}
+
+		// Every view is counted until the limit, which removes the paste,
+		limited := Paste{Id: "limited", Hash: shaPaste("limited"), Data: "limited",
+			MaxViews: 2, Revision: 1}
+		if err := store.Save(limited); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 2; i++ {
+			v, err := store.View("limited")
+			if err != nil || v.Views != i {
+				t.Fatalf("view %d : got %d (%v)", i, v.Views, err)
+			}
+		}
+		if _, err := store.View("limited"); err != ErrNotFound {
+			t.Fatalf("view without views left : got %v", err)
+		}
+		if exists, err := store.Exists("limited"); err != nil || exists {
+			t.Fatalf("paste without views left : exists %v (%v)", exists, err)
+		}
+
+		// A revision replaces the data and keeps the old one, along with
+		// when it was saved, the paste keeps its created date,
+		revised, err := store.Revise(Paste{Id: "one", Title: "Two", Hash: shaPaste("two\n"),
+			Data: "two\n", Lang: "python", Style: "vim", Filename: "two.py",
+			Edited: 1700000100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revised.Revision != 2 || revised.Data != "two\n" || revised.DelKey != "key" ||
+			revised.Owner != "alice" || revised.Created != 1700000000 ||
+			revised.Edited != 1700000100 {
+			t.Fatalf("revise : got %+v", revised)
+		}
+		if got, err := store.Get("one"); err != nil || !reflect.DeepEqual(got, revised) {
+			t.Fatalf("get revised : got %+v (%v)", got, err)
+		}
+		_, err = store.Revise(Paste{Id: "one", Title: "Three", Hash: shaPaste("three\n"),
+			Data: "three\n", Edited: 1700000200})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs, err := store.Revisions("one")
+		if err != nil || len(revs) != 2 || revs[0].Revision != 1 || revs[0].Data != "one\n" ||
+			revs[0].Created != 1700000000 || revs[1].Created != 1700000100 {
+			t.Fatalf("revisions : got %+v (%v)", revs, err)
+		}
+		old, err := store.GetRevision("one", 1)
+		if err != nil || old.Title != "One" || old.Hash != p.Hash || old.Filename != "one.go" {
+			t.Fatalf("revision 1 : got %+v (%v)", old, err)
+		}
+		if _, err := store.GetRevision("one", 4); err != ErrNotFound {
+			t.Fatalf("missing revision : got %v", err)
+		}
+		if _, err := store.Revise(Paste{Id: "missing", Data: "x"}); err != ErrNotFound {
+			t.Fatalf("revise missing : got %v", err)
+		}
+
+		// Forks are listed by id,
+		for _, id := range []string{"fork2", "fork1"} {
+			err := store.Save(Paste{Id: id, Hash: shaPaste(id), Data: id, Revision: 1,
+				Parent: "one", ParentRev: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		forks, err := store.Forks("one")
+		if err != nil || len(forks) != 2 || forks[0].Id != "fork1" || forks[1].Id != "fork2" {
+			t.Fatalf("forks : got %+v (%v)", forks, err)
+		}
+
+		// The other files of a bundle come back in order, and go with it,
+		files := []File{
+			{Filename: "b.txt", Hash: shaPaste("b"), Data: "b"},
+			{Filename: "a.go", Lang: "go", Hash: shaPaste("a"), Data: "a"},
+		}
+		err = store.Save(Paste{Id: "bundle", Hash: "bundle", Data: "first", Revision: 1,
+			Filename: "first.txt", Files: files})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Files("bundle"); err != nil || !reflect.DeepEqual(got, files) {
+			t.Fatalf("files : got %+v (%v)", got, err)
+		}
+		if got, err := store.Files("one"); err != nil || len(got) != 0 {
+			t.Fatalf("files of a single file : got %+v (%v)", got, err)
+		}
+		if err := store.Delete("bundle"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Files("bundle"); err != nil || len(got) != 0 {
+			t.Fatalf("files of a deleted bundle : got %+v (%v)", got, err)
+		}
+		if err := store.Delete("bundle"); err != ErrNotFound {
+			t.Fatalf("delete missing : got %v", err)
+		}
+	})
+}
+
+func TestOwned(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+
+		files := []File{{Filename: "b.txt", Hash: shaPaste("b"), Data: "b"}}
+		for _, p := range []Paste{
+			{Id: "single", Hash: shaPaste("single"), Data: "single", Revision: 1,
+				Created: 100, Owner: "alice"},
+			{Id: "bundle", Hash: "bundle", Data: "a", Filename: "a.txt", Revision: 1,
+				Created: 200, Owner: "alice", Files: files},
+			{Id: "other", Hash: shaPaste("other"), Data: "other", Revision: 1,
+				Created: 300, Owner: "bob", Files: files},
+		} {
+			if err := store.Save(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Newest first, with the files of bundles but not their data,
+		owned, err := users.Owned("alice")
+		if err != nil || len(owned) != 2 || owned[0].Id != "bundle" || owned[1].Id != "single" {
+			t.Fatalf("owned : got %+v (%v)", owned, err)
+		}
+		if len(owned[0].Files) != 1 || owned[0].Files[0].Filename != "b.txt" ||
+			owned[0].Files[0].Hash != files[0].Hash || owned[0].Files[0].Data != "" {
+			t.Fatalf("files of the bundle : got %+v", owned[0].Files)
+		}
+		if len(owned[1].Files) != 0 {
+			t.Fatalf("files of a single file : got %+v", owned[1].Files)
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxUploadSize is the max size in bytes of an uploaded paste.
+const maxUploadSize = 10 << 20
+
+// inlineTypes are the binary types that are safe to show in the browser,
+// everything else is sent as an attachment so no uploaded html or svg is
+// ever run from our origin.
+var inlineTypes = map[string]bool{
+	"image/bmp":  true,
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// mediaType returns the media type of the request without any parameters.
+func mediaType(r *http.Request) string {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// detectMime returns the mime type of the data. The type given by the client
+// (if any) is only used when the data itself doesn't tell.
+func detectMime(data []byte, given string) string {
+
+	detected := http.DetectContentType(data)
+	if detected == "application/octet-stream" && given != "" {
+		if mt, _, err := mime.ParseMediaType(given); err == nil &&
+			!strings.HasPrefix(mt, "text/") {
+			return mt
+		}
+	}
+
+	return detected
+}
+
+// isBinary reports whether data of the given mime type has to be stored as a
+// blob instead of as text.
+func isBinary(data []byte, mimeType string) bool {
+	return !strings.HasPrefix(mimeType, "text/") || !utf8.Valid(data)
+}
+
+// headerPrefix is the prefix of the headers that can be used instead of form
+// fields or url parameters, for example X-Paste-Title.
+const headerPrefix = "X-Paste-"
+
+// formRequest builds a Request from anything but json. The data is taken
+// from,
+// multipart/form-data, the "paste" field or file,
+// application/x-www-form-urlencoded, the "paste" field, or the whole body if
+// there is no such field (which is what curl --data-binary sends),
+// anything else (text/plain, application/octet-stream ...), the whole body.
+// Everything else is taken from the form fields, the url parameters or the
+// X-Paste-* headers, in that order.
+func formRequest(w http.ResponseWriter, r *http.Request) (Request, error) {
+
+	var inData Request
+	var data []byte
+	var given string
+	var err error
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	fields := r.URL.Query()
+
+	switch mediaType(r) {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			return inData, err
+		}
+		for k, v := range r.MultipartForm.Value {
+			fields[k] = v
+		}
+
+		// Several files makes a bundle, named after the first one just like
+		// a single file,
+		if headers := r.MultipartForm.File["paste"]; len(headers) > 1 {
+			inData.Files, err = readFiles(headers)
+			if err != nil {
+				return inData, err
+			}
+			inData.Title = filenameTitle(headers[0].Filename)
+			break
+		}
+
+		file, header, err := r.FormFile("paste")
+		switch {
+		case err == http.ErrMissingFile:
+			data = []byte(fields.Get("paste"))
+		case err != nil:
+			return inData, err
+		default:
+			data, err = io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return inData, err
+			}
+			given = header.Header.Get("Content-Type")
+			inData.Title = filenameTitle(header.Filename)
+			inData.Filename = header.Filename
+		}
+
+	case "application/x-www-form-urlencoded":
+		data, err = io.ReadAll(r.Body)
+		if err != nil {
+			return inData, err
+		}
+
+		if form, err := url.ParseQuery(string(data)); err == nil &&
+			form.Has("paste") {
+			for k, v := range form {
+				fields[k] = v
+			}
+			data = []byte(form.Get("paste"))
+		}
+
+	default:
+		data, err = io.ReadAll(r.Body)
+		if err != nil {
+			return inData, err
+		}
+	}
+
+	value := func(name string) string {
+		if v := fields.Get(name); v != "" {
+			return v
+		}
+		return r.Header.Get(headerPrefix + name)
+	}
+
+	inData.Paste = string(data)
+	inData.Mime = detectMime(data, given)
+	inData.Binary = isBinary(data, inData.Mime)
+
+	if title := value("title"); title != "" {
+		inData.Title = title
+	}
+	if filename := value("filename"); filename != "" {
+		inData.Filename = filename
+	}
+	inData.Lang = value("lang")
+	inData.Style = value("style")
+	inData.Password = value("password")
+	inData.DelKey = value("delkey")
+	inData.Parent = value("parent")
+
+	if v := value("expiry"); v != "" {
+		if inData.Expiry, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return inData, fmt.Errorf("invalid expiry '%s'", v)
+		}
+	}
+
+	if v := value("maxviews"); v != "" {
+		if inData.MaxViews, err = strconv.Atoi(v); err != nil {
+			return inData, fmt.Errorf("invalid maxviews '%s'", v)
+		}
+	}
+
+	if v := value("burn"); v != "" {
+		if inData.Burn, err = strconv.ParseBool(v); err != nil {
+			return inData, fmt.Errorf("invalid burn '%s'", v)
+		}
+	}
+
+	loggy(fmt.Sprintf("Received %s upload of %d bytes detected as '%s' (binary %v)",
+		mediaType(r), len(data), inData.Mime, inData.Binary))
+
+	return inData, nil
+}
+
+// readFiles reads the files of a bundle upload, the languages are picked
+// from the file names.
+func readFiles(headers []*multipart.FileHeader) ([]RequestFile, error) {
+
+	var files []RequestFile
+	for _, h := range headers {
+		file, err := h.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		mimeType := detectMime(data, h.Header.Get("Content-Type"))
+		files = append(files, RequestFile{
+			Binary:   isBinary(data, mimeType),
+			Filename: h.Filename,
+			Paste:    string(data),
+		})
+	}
+	return files, nil
+}
+
+// cleanFilename strips any directories (from either kind of os) from a file
+// name given by a client.
+func cleanFilename(name string) string {
+	name = name[strings.LastIndexAny(name, "/\\")+1:]
+	if name == "." || name == ".." {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// filenameTitle returns the title of a paste uploaded with the given file
+// name, the name is cut to fit.
+func filenameTitle(name string) string {
+
+	title := cleanFilename(name)
+	for len(title) > maxTitleLength {
+		_, size := utf8.DecodeLastRuneInString(title)
+		title = title[:len(title)-size]
+	}
+	return title
+}
+
+// downloadName returns the file name a paste is downloaded as, the name it
+// was uploaded with or else the title.
+func downloadName(p Response) string {
+	if p.Filename != "" {
+		return p.Filename
+	}
+	return p.Title
+}
+
+// langForFilename returns the alias of the language whose file name patterns
+// (like *.go) matches the name, "" if there is none. Prioritized languages
+// wins if several matches.
+func langForFilename(name string) string {
+
+	lang := ""
+	for _, l := range supportedLanguages() {
+		for _, pattern := range l.Extensions {
+			if ok, _ := path.Match(pattern, name); !ok {
+				continue
+			}
+			if l.Prioritized {
+				return l.Alias
+			}
+			if lang == "" {
+				lang = l.Alias
+			}
+		}
+	}
+
+	return lang
+}
+
+// wantsPlainText reports whether the client asked for a text/plain answer
+// rather than json.
+func wantsPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") &&
+		!strings.Contains(accept, "application/json")
+}
+
+// writeBinaryPaste writes the original bytes of a binary paste. Types in
+// inlineTypes are shown in the browser unless attachment is set, everything
+// else is always sent as an attachment.
+func writeBinaryPaste(w http.ResponseWriter, p Response, attachment bool) {
+
+	mt, _, _ := mime.ParseMediaType(p.Mime)
+	if attachment || !inlineTypes[mt] {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": downloadName(p)}))
+	}
+
+	w.Header().Set("Content-Type", p.Mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.Paste)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.WriteString(w, p.Paste)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// multipartBody returns the body and the content type of an upload of the
+// given files, keyed by name.
+func multipartBody(t *testing.T, names []string, data []string) (string, string) {
+	t.Helper()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for i, name := range names {
+		fw, err := mw.CreateFormFile("paste", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data[i]))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String(), mw.FormDataContentType()
+}
+
+func TestUploadLongFilename(t *testing.T) {
+	resetStore()
+
+	name := strings.Repeat("å", 40) + ".txt"
+	body, contentType := multipartBody(t, []string{name}, []string{"uploaded\n"})
+
+	w := do("POST", "/api", body, map[string]string{"Content-Type": contentType})
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload : got %d (%s)", w.Code, w.Body.String())
+	}
+
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filename != name {
+		t.Fatalf("filename : got %q", p.Filename)
+	}
+	if len(p.Title) > maxTitleLength || !utf8.ValidString(p.Title) ||
+		!strings.HasPrefix(name, p.Title) {
+		t.Fatalf("title : got %q", p.Title)
+	}
+}
+
+func TestLongTitle(t *testing.T) {
+	resetStore()
+
+	w := do("POST", "/api", `{"paste": "titled", "title": "`+
+		strings.Repeat("x", maxTitleLength+1)+`"}`,
+		map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("long title : got %d", w.Code)
+	}
+}
+
+func TestBundleUploadLongFilenames(t *testing.T) {
+	resetStore()
+
+	first := strings.Repeat("a", 60) + ".go"
+	second := strings.Repeat("ö", 100) + ".txt"
+	body, contentType := multipartBody(t, []string{first, second},
+		[]string{"package main\n", "text\n"})
+
+	w := do("POST", "/api", body, map[string]string{"Content-Type": contentType})
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload : got %d (%s)", w.Code, w.Body.String())
+	}
+	var p Response
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Files) != 2 || p.Files[0].Filename != first || p.Files[1].Filename != second {
+		t.Fatalf("files : got %+v", p.Files)
+	}
+	if p.Title != first[:maxTitleLength] {
+		t.Fatalf("title : got %q", p.Title)
+	}
+	if code, body := raw(p.Id+"/"+second, nil); code != http.StatusOK || body != "text\n" {
+		t.Fatalf("raw file : got %d %q", code, body)
+	}
+
+	// Names that are too long to keep are refused, not a server error,
+	long := strings.Repeat("b", 256)
+	for _, names := range [][]string{{long}, {first, long}} {
+		body, contentType := multipartBody(t, names, []string{"one\n", "two\n"})
+		w := do("POST", "/api", body, map[string]string{"Content-Type": contentType})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("upload of %d files with a long name : got %d", len(names), w.Code)
+		}
+	}
+}